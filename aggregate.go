@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+)
+
+// aggregation modes of multiple devices
+const (
+	aggregateNone = ""
+	aggregateMean = "mean"
+)
+
+// runAggregate reads each of cfg.devices into a state of its own and stores
+// the mean of their fresh readings into st each time one of them reports
+func runAggregate(ctx context.Context, cfg *config, st *state) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	devices := make([]*state, len(cfg.devices))
+	errs := make([]error, len(cfg.devices))
+	updated := make(chan struct{}, 1)
+	for i, device := range cfg.devices {
+		c := *cfg
+		c.devices, c.device = deviceList{device}, device
+		c.maxReadings = 0 // counted on the combined readings
+		dst := newState(&c)
+		devices[i] = dst
+
+		ch, unsubscribe := dst.subs.Subscribe(1)
+		defer unsubscribe()
+		go func() {
+			for range ch {
+				select {
+				case updated <- struct{}{}:
+				default:
+				}
+			}
+		}()
+
+		wg.Add(1)
+		go func(i int, device string) {
+			defer wg.Done()
+			if err := runReader(ctx, &c, dst); err != nil {
+				// the other devices are still combined, so tell right away
+				log.Printf("Warning: device %v failed, combining the others: %v\n", device, err)
+				errs[i] = fmt.Errorf("%v: %w", device, err)
+				if errors.Is(err, errParseErrors) || errors.Is(err, errNoStream) {
+					cancel()
+				}
+			}
+		}(i, device)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			err := errors.Join(errs...)
+			if err != nil {
+				st.SetStatus(statusUnavailable)
+			}
+			return err
+		case <-updated:
+		}
+		d := mean(cfg, devices)
+		if d == nil {
+			continue
+		}
+		st.Update(d)
+		if cfg.maxReadings > 0 && st.Seq() >= cfg.maxReadings {
+			cancel()
+		}
+	}
+}
+
+// mean combines the latest readings of the devices not older than cfg.aggregateMaxAge.
+// It returns nil if there is no such reading.
+func mean(cfg *config, devices []*state) *Data {
+	var ds []*Data
+	for _, st := range devices {
+		if d := st.Latest(); d != nil && d.age() <= cfg.aggregateMaxAge {
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+
+	avg := func(f func(d *Data) *float64) *float64 {
+		var sum float64
+		n := 0
+		for _, d := range ds {
+			if v := f(d); v != nil {
+				sum += *v
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		m := sum / float64(n)
+		return &m
+	}
+	f := func(v int64) *float64 {
+		x := float64(v)
+		return &x
+	}
+
+	latest := ds[0]
+	lo, hi := ds[0].CO2, ds[0].CO2
+	for _, d := range ds[1:] {
+		if d.elapsed > latest.elapsed {
+			latest = d
+		}
+		lo, hi = min(lo, d.CO2), max(hi, d.CO2)
+	}
+	spread := hi - lo
+	d := &Data{
+		CO2:          int64(math.Round(*avg(func(d *Data) *float64 { return f(d.CO2) }))),
+		Humidity:     avg(func(d *Data) *float64 { return d.Humidity }),
+		Temperature:  avg(func(d *Data) *float64 { return d.Temperature }),
+		Timestamp:    latest.Timestamp,
+		Location:     cfg.location,
+		SensorSpread: &spread,
+		elapsed:      latest.elapsed,
+	}
+	if c := avg(func(d *Data) *float64 {
+		if d.CO2Compensated == nil {
+			return nil
+		}
+		return f(*d.CO2Compensated)
+	}); c != nil {
+		cc := int64(math.Round(*c))
+		d.CO2Compensated = &cc
+	}
+	if cfg.comfort {
+		if i, l, ok := comfort(d, cfg.comfortThresholdList); ok {
+			d.ComfortIndex, d.ComfortLevel = &i, l
+		}
+	}
+	return d
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// defaultBaudRate is the baud rate of the UD-CO2S
+const defaultBaudRate = 115200
+
+// baudRates are the candidates tried by -auto-baud, the default first
+var baudRates = []int{defaultBaudRate, 38400, 9600}
+
+// probeTimeout is how long a candidate baud rate is given to produce a sane response
+const probeTimeout = 2 * time.Second
+
+// readTimeout is the read timeout of the serial port
+const readTimeout = 10 * time.Second
+
+// serialParams are the effective parameters of an open serial port
+type serialParams struct {
+	BaudRate           int     `json:"baud_rate"`
+	DataBits           int     `json:"data_bits"`
+	StopBits           string  `json:"stop_bits"`
+	Parity             string  `json:"parity"`
+	ReadTimeoutSeconds float64 `json:"read_timeout_seconds"`
+}
+
+func newSerialParams(m *serial.Mode) *serialParams {
+	stopBits := map[serial.StopBits]string{
+		serial.OneStopBit:           "1",
+		serial.OnePointFiveStopBits: "1.5",
+		serial.TwoStopBits:          "2",
+	}
+	parity := map[serial.Parity]string{
+		serial.NoParity:    "none",
+		serial.OddParity:   "odd",
+		serial.EvenParity:  "even",
+		serial.MarkParity:  "mark",
+		serial.SpaceParity: "space",
+	}
+	return &serialParams{
+		BaudRate:           m.BaudRate,
+		DataBits:           m.DataBits,
+		StopBits:           stopBits[m.StopBits],
+		Parity:             parity[m.Parity],
+		ReadTimeoutSeconds: readTimeout.Seconds(),
+	}
+}
+
+func serialMode(baudRate int) *serial.Mode {
+	return &serial.Mode{
+		BaudRate: baudRate,
+		DataBits: 8,
+		StopBits: serial.OneStopBit,
+		Parity:   serial.NoParity,
+	}
+}
+
+// probeBaudRate switches p through baudRates and keeps the first one at which
+// the device answers ID? or streams a reading
+func probeBaudRate(p serial.Port) (int, error) {
+	for _, rate := range baudRates {
+		if err := p.SetMode(serialMode(rate)); err != nil {
+			return 0, err
+		}
+		p.ResetInputBuffer()
+		if _, err := p.Write([]byte("ID?\r\n")); err != nil {
+			return 0, err
+		}
+		if sane(p, probeTimeout) {
+			log.Printf("Detected baud rate: %v\n", rate)
+			return rate, nil
+		}
+	}
+	return 0, fmt.Errorf("no sane response at any of the baud rates %v", baudRates)
+}
+
+// sane reports whether p produces a line looking like a response or a
+// reading of the device within timeout
+func sane(p serial.Port, timeout time.Duration) bool {
+	p.SetReadTimeout(100 * time.Millisecond)
+	var buf []byte
+	b := make([]byte, 256)
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		n, err := p.Read(b)
+		if err != nil {
+			return false
+		}
+		buf = append(buf, b[:n]...)
+		for {
+			// CR alone ends the lines of devices needing -line-ending cr
+			i := bytes.IndexAny(buf, "\r\n")
+			if i < 0 {
+				break
+			}
+			if t := trimLine(string(buf[:i])); isResponse(t, "OK") || strings.HasPrefix(t, "CO2=") {
+				return true
+			}
+			buf = buf[i+1:]
+		}
+	}
+	return false
+}
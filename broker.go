@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// broker delivers each published reading to the current subscribers
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan *Data]string // the sink name, or "" for a /stream client
+}
+
+func newBroker() *broker {
+	return &broker{subs: map[chan *Data]string{}}
+}
+
+// Subscribe returns a channel receiving the published readings and a function to unsubscribe.
+// Readings are dropped for a subscriber whose buffer of size buf is full.
+func (b *broker) Subscribe(buf int) (<-chan *Data, func()) {
+	return b.SubscribeSink("", buf)
+}
+
+// SubscribeSink is Subscribe for the sink name, whose queue length is reported by Queues.
+func (b *broker) SubscribeSink(name string, buf int) (<-chan *Data, func()) {
+	c := make(chan *Data, buf)
+	b.mu.Lock()
+	b.subs[c] = name
+	b.mu.Unlock()
+	return c, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+}
+
+// Publish sends d to the subscribers without blocking
+func (b *broker) Publish(d *Data) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.subs {
+		select {
+		case c <- d:
+		default:
+		}
+	}
+}
+
+// Len returns the number of subscribers
+func (b *broker) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Queues returns the number of readings waiting in the buffer of each sink subscribed by name
+func (b *broker) Queues() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queues := map[string]int{}
+	for c, name := range b.subs {
+		if name != "" {
+			queues[name] += len(c)
+		}
+	}
+	return queues
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cpuQuota returns the CPU quota of the cgroup of the process, rounded up to
+// whole CPUs, from cgroup v2 or else v1. ok is false if there is no quota.
+func cpuQuota() (n int, ok bool) {
+	var quota, period string
+	if b, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		quota, period, _ = strings.Cut(strings.TrimSpace(string(b)), " ")
+	} else {
+		q, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		if err != nil {
+			return 0, false
+		}
+		p, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+		if err != nil {
+			return 0, false
+		}
+		quota, period = strings.TrimSpace(string(q)), strings.TrimSpace(string(p))
+	}
+	q, err := strconv.ParseFloat(quota, 64) // "max" or -1 if unlimited
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return max(int(math.Ceil(q/p)), 1), true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// cpuQuota reports no quota where cgroups are not available
+func cpuQuota() (n int, ok bool) {
+	return 0, false
+}
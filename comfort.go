@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// comfort levels, from the lowest humidex to the highest
+var comfortLevels = []string{"comfortable", "some_discomfort", "great_discomfort", "dangerous"}
+
+// defaultComfortThresholds are the humidex values at which each level
+// after the first starts, as used by Environment Canada
+const defaultComfortThresholds = "30,40,46"
+
+// parseComfortThresholds parses the comma separated, increasing humidex
+// values at which each comfort level after the first starts
+func parseComfortThresholds(s string) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != len(comfortLevels)-1 {
+		return nil, fmt.Errorf("invalid comfort thresholds %q: %v values are required", s, len(comfortLevels)-1)
+	}
+	ts := make([]float64, len(fields))
+	for i, f := range fields {
+		t, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid comfort thresholds %q: %w", s, err)
+		}
+		if i > 0 && t <= ts[i-1] {
+			return nil, fmt.Errorf("invalid comfort thresholds %q: values must be increasing", s)
+		}
+		ts[i] = t
+	}
+	return ts, nil
+}
+
+// humidex returns the humidex for the temperature t in °C and the relative humidity h in %,
+// taking the vapor pressure from the same Magnus formula as the humidity correction
+func humidex(t, h float64) float64 {
+	e := 6.1078 * magnus(t) * h / 100
+	return t + 0.5555*(e-10)
+}
+
+// comfort returns the humidex of d and its level given the thresholds.
+// ok is false when d lacks the temperature or the humidity or they are out of range.
+func comfort(d *Data, thresholds []float64) (index float64, level string, ok bool) {
+	if d.Temperature == nil || d.Humidity == nil {
+		return 0, "", false
+	}
+	t, h := *d.Temperature, *d.Humidity
+	if h < 0 || h > 100 || t < -50 || t > 60 {
+		return 0, "", false
+	}
+	index = humidex(t, h)
+	if math.IsNaN(index) || math.IsInf(index, 0) {
+		return 0, "", false
+	}
+	level = comfortLevels[0]
+	for i, th := range thresholds {
+		if index >= th {
+			level = comfortLevels[i+1]
+		}
+	}
+	return index, level, true
+}
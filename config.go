@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// deviceList is a flag accumulating devices each time it is given
+type deviceList []string
+
+func (l *deviceList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *deviceList) Set(v string) error {
+	if v == "" {
+		return errors.New("device must not be empty")
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// config is the configuration given by the command line flags
+type config struct {
+	devices    deviceList
+	device     string // the device to read, set from devices by validate
+	replay     bool   // device is a file to replay
+	autoBaud   bool
+	lineEnding string
+	location   string
+	co2Offset  int64
+
+	aggregate       string
+	aggregateMaxAge time.Duration
+
+	humidityBasis string
+	pressure      float64 // hPa, 0 if unknown
+
+	includeCorrections bool
+
+	comfort              bool
+	comfortThresholds    string
+	comfortThresholdList []float64 // parsed from comfortThresholds by validate
+
+	record        string
+	recordMaxSize int64
+
+	addr          string
+	listenNet     string
+	addrFallback  int
+	authToken     string
+	maxBodySize   int64
+	reuseAddr     bool
+	h2c           bool
+	httpKeepAlive bool
+	simInterval   time.Duration
+	simSeed       int64
+	staticDir     string
+	fifo          string
+	noHTTP        bool
+
+	redisAddr         string
+	redisPassword     string
+	redisKey          string
+	redisTTL          time.Duration
+	redisChannel      string
+	exportMinInterval time.Duration
+
+	grafanaJSON    bool
+	grafanaHistory int // readings kept for -grafana-json
+
+	buffer        int // queued readings per subscriber
+	format        string
+	maxStale      time.Duration
+	serveStale    bool
+	maxReadings   uint64 // readings after which the server shuts down, 0 if unlimited
+	statsInterval time.Duration
+
+	co2AsString     bool
+	co2Unit         string
+	decimals        int
+	timestampFormat string
+
+	homeKitThreshold int64
+
+	ventOn  int64
+	ventOff int64
+
+	plausibility         bool
+	co2Range             string
+	temperatureRange     string
+	humidityRange        string
+	plausibleCO2         valueRange // parsed from co2Range by validate, and so on
+	plausibleTemperature valueRange
+	plausibleHumidity    valueRange
+	maxTemperatureStep   float64
+	maxHumidityStep      float64
+
+	directionWindow   time.Duration
+	directionDeadband float64
+
+	gapFactor float64
+	markGaps  bool
+
+	watchdog       time.Duration
+	reconnectDelay time.Duration
+	stopDrain      time.Duration
+	prepareTimeout time.Duration
+	streamTimeout  time.Duration
+	onNoStream     string
+
+	onParseErrors       string
+	parseErrorThreshold float64
+	parseWindow         int
+	unmatchedLines      int
+
+	gomaxprocs int
+	maxMemory  int64
+
+	profileCPU         string
+	profileCPUDuration time.Duration
+	profileMem         string
+}
+
+// validate checks the configuration and fills in the defaults depending on other values
+func (c *config) validate() error {
+	// giving the same device more than once means giving it once
+	var devices deviceList
+	for _, d := range c.devices {
+		if !slices.Contains(devices, d) {
+			devices = append(devices, d)
+		}
+	}
+	c.devices = devices
+	switch c.aggregate {
+	case aggregateNone, aggregateMean:
+	default:
+		return fmt.Errorf("invalid aggregation: %v", c.aggregate)
+	}
+	switch len(c.devices) {
+	case 0:
+		return errors.New("device is required")
+	case 1:
+		c.device = c.devices[0]
+	default:
+		if c.aggregate == aggregateNone {
+			return fmt.Errorf("reading multiple devices requires -aggregate: %v", c.devices.String())
+		}
+		if c.record != "" {
+			return errors.New("recording multiple devices is not supported")
+		}
+		if c.aggregateMaxAge <= 0 {
+			return errors.New("aggregate max age must be positive")
+		}
+		c.device = c.devices.String()
+	}
+	if c.noHTTP && c.fifo == "" && c.redisAddr == "" {
+		return errors.New("-no-http requires -fifo or -redis-addr, otherwise the readings go nowhere")
+	}
+	if c.redisAddr != "" && c.redisKey == "" && c.redisChannel == "" {
+		return errors.New("-redis-addr requires -redis-key or -redis-channel")
+	}
+	if c.redisAddr == "" && (c.redisKey != "" || c.redisChannel != "") {
+		return errors.New("-redis-key and -redis-channel require -redis-addr")
+	}
+	if c.redisTTL < 0 {
+		return errors.New("redis ttl must not be negative")
+	}
+	if c.exportMinInterval < 0 {
+		return errors.New("export min interval must not be negative")
+	}
+	switch c.format {
+	case "", formatJSON, formatXML, formatCBOR, formatCSV, formatPrometheus: // empty without the server flags
+	default:
+		return fmt.Errorf("invalid format: %v", c.format)
+	}
+	if c.grafanaJSON && c.grafanaHistory <= 0 {
+		return errors.New("grafana history must be positive")
+	}
+	if c.buffer < 0 {
+		return errors.New("buffer must not be negative")
+	}
+	if c.listenNet != "" {
+		addr, err := resolveListenAddr(c.addr, c.listenNet)
+		if err != nil {
+			return err
+		}
+		c.addr = addr
+	}
+	if c.staticDir != "" {
+		if fi, err := os.Stat(c.staticDir); err != nil {
+			return fmt.Errorf("invalid static dir: %w", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("invalid static dir: %v is not a directory", c.staticDir)
+		}
+	}
+	if c.pressure < 0 {
+		return errors.New("pressure must not be negative")
+	}
+	switch c.lineEnding {
+	case lineEndingCRLF, lineEndingLF, lineEndingCR:
+	default:
+		return fmt.Errorf("invalid line ending: %v", c.lineEnding)
+	}
+	switch c.humidityBasis {
+	case humidityBasisRaw, humidityBasisCorrected, humidityBasisNone:
+	default:
+		return fmt.Errorf("invalid humidity basis: %v", c.humidityBasis)
+	}
+	if c.comfort {
+		ts, err := parseComfortThresholds(c.comfortThresholds)
+		if err != nil {
+			return err
+		}
+		c.comfortThresholdList = ts
+	}
+	switch c.timestampFormat {
+	case timestampISO8601, timestampUnix, timestampUnixMilli, timestampRFC3339Nano:
+	default:
+		return fmt.Errorf("invalid timestamp format: %v", c.timestampFormat)
+	}
+	switch c.co2Unit {
+	case co2UnitPPM, co2UnitPercent:
+	default:
+		return fmt.Errorf("invalid co2 unit: %v", c.co2Unit)
+	}
+	if c.ventOn < 0 {
+		return errors.New("vent on must not be negative")
+	}
+	if c.ventOn > 0 && (c.ventOff <= 0 || c.ventOff >= c.ventOn) {
+		return errors.New("vent off must be positive and below vent on")
+	}
+	if c.plausibility {
+		var err error
+		if c.plausibleCO2, err = parseRange("co2", c.co2Range); err != nil {
+			return err
+		}
+		if c.plausibleTemperature, err = parseRange("temperature", c.temperatureRange); err != nil {
+			return err
+		}
+		if c.plausibleHumidity, err = parseRange("humidity", c.humidityRange); err != nil {
+			return err
+		}
+		if c.maxTemperatureStep < 0 || c.maxHumidityStep < 0 {
+			return errors.New("max steps must not be negative")
+		}
+	}
+	if c.directionWindow < 0 {
+		return errors.New("direction window must not be negative")
+	}
+	if c.directionDeadband < 0 {
+		return errors.New("direction deadband must not be negative")
+	}
+	if c.gapFactor != 0 && c.gapFactor <= 1 {
+		return errors.New("gap factor must be above 1 or 0")
+	}
+	if c.addrFallback < 0 {
+		return errors.New("addr fallback must not be negative")
+	}
+	if c.maxBodySize < 0 {
+		return errors.New("max body size must not be negative")
+	}
+	if c.watchdog < 0 {
+		return errors.New("watchdog must not be negative")
+	}
+	if c.watchdog > 0 && c.watchdog < minWatchdog {
+		return fmt.Errorf("watchdog must be 0 or at least %v", minWatchdog)
+	}
+	if c.statsInterval < 0 {
+		return errors.New("stats interval must not be negative")
+	}
+	if c.stopDrain < 0 {
+		return errors.New("stop drain must not be negative")
+	}
+	if c.prepareTimeout < 0 {
+		return errors.New("prepare timeout must not be negative")
+	}
+	if c.streamTimeout < 0 {
+		return errors.New("stream timeout must not be negative")
+	}
+	switch c.onNoStream {
+	case noStreamRetry, noStreamExit:
+	default:
+		return fmt.Errorf("invalid no stream policy: %v", c.onNoStream)
+	}
+	switch c.onParseErrors {
+	case parseErrorsIgnore, parseErrorsWarn, parseErrorsExit:
+	default:
+		return fmt.Errorf("invalid parse error policy: %v", c.onParseErrors)
+	}
+	if c.parseErrorThreshold < 0 || c.parseErrorThreshold > 1 {
+		return errors.New("parse error threshold must be between 0 and 1")
+	}
+	if c.parseWindow <= 0 {
+		return errors.New("parse window must be positive")
+	}
+	if c.unmatchedLines < 0 {
+		return errors.New("unmatched lines must not be negative")
+	}
+	if c.gomaxprocs < 0 {
+		return errors.New("gomaxprocs must not be negative")
+	}
+	if c.maxMemory < 0 {
+		return errors.New("max memory must not be negative")
+	}
+	if c.profileCPUDuration < 0 {
+		return errors.New("CPU profile duration must not be negative")
+	}
+	if c.simSeed == 0 {
+		c.simSeed = time.Now().UnixNano()
+	}
+	return nil
+}
+
+// logSummary logs the effective configuration on a single line, redacting secrets
+func (c *config) logSummary() {
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "***"
+	}
+	attrs := []any{
+		"version", version(),
+		"device", c.device,
+		"aggregate", c.aggregate,
+		"replay", c.replay,
+		"location", c.location,
+		"addr", c.addr,
+		"no_http", c.noHTTP,
+		"static_dir", c.staticDir,
+		"auth_token", redact(c.authToken),
+		"fifo", c.fifo,
+		"grafana_json", c.grafanaJSON,
+	}
+	if c.grafanaJSON {
+		attrs = append(attrs, "grafana_history", c.grafanaHistory)
+	}
+	attrs = append(attrs,
+		"redis_addr", c.redisAddr,
+		"redis_key", c.redisKey,
+		"redis_channel", c.redisChannel,
+		"co2_offset", c.co2Offset,
+		"temperature_offset", -temperatureOffset,
+		"humidity_basis", c.humidityBasis,
+		"pressure_hpa", c.pressure,
+		"co2_unit", c.co2Unit,
+		"decimals", c.decimals,
+		"plausibility", c.plausibility,
+	)
+	if c.plausibility {
+		attrs = append(attrs,
+			"co2_range", c.co2Range,
+			"temperature_range", c.temperatureRange,
+			"humidity_range", c.humidityRange,
+			"max_temperature_step", c.maxTemperatureStep,
+			"max_humidity_step", c.maxHumidityStep,
+		)
+	}
+	attrs = append(attrs, "comfort", c.comfort)
+	if c.comfort {
+		attrs = append(attrs, "comfort_thresholds", c.comfortThresholds)
+	}
+	attrs = append(attrs,
+		"watchdog", c.watchdog,
+		"record", c.record,
+		"on_parse_errors", c.onParseErrors,
+		"gomaxprocs", runtime.GOMAXPROCS(0),
+	)
+	slog.Info("starting", attrs...)
+}
+
+// version returns the module version of the binary, e.g. set by `go install`
+func version() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "unknown"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// parseConfig parses args with the flags of serve and validates the configuration
+func parseConfig(args ...string) (*config, error) {
+	cfg := &config{}
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	deviceFlags(fs, cfg)
+	readerFlags(fs, cfg)
+	outputFlags(fs, cfg)
+	serverFlags(fs, cfg)
+	runtimeFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// testConfig returns the validated configuration of serve given args
+func testConfig(t *testing.T, args ...string) *config {
+	t.Helper()
+	cfg, err := parseConfig(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestDeviceFlag(t *testing.T) {
+	tests := []struct {
+		args    string
+		devices []string
+		device  string
+	}{
+		{"-device /dev/ttyACM0", []string{"/dev/ttyACM0"}, "/dev/ttyACM0"},
+		{"-device /dev/ttyACM0 -device /dev/ttyACM1 -aggregate mean", []string{"/dev/ttyACM0", "/dev/ttyACM1"}, "/dev/ttyACM0,/dev/ttyACM1"},
+		// giving a device twice is giving it once, which needs no -aggregate
+		{"-device /dev/ttyACM0 -device /dev/ttyACM0", []string{"/dev/ttyACM0"}, "/dev/ttyACM0"},
+		{"-device /dev/ttyACM0 -device /dev/ttyACM1 -device /dev/ttyACM0 -aggregate mean", []string{"/dev/ttyACM0", "/dev/ttyACM1"}, "/dev/ttyACM0,/dev/ttyACM1"},
+	}
+	for _, tt := range tests {
+		cfg, err := parseConfig(strings.Fields(tt.args)...)
+		if err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(cfg.devices, tt.devices) || cfg.device != tt.device {
+			t.Errorf("%v: devices %v, device %v, want %v, %v", tt.args, cfg.devices, cfg.device, tt.devices, tt.device)
+		}
+	}
+}
+
+func TestDeviceFlagRejected(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "device is required"},
+		{[]string{"-device", ""}, "device must not be empty"},
+		{[]string{"-device", "/dev/ttyACM0", "-device", ""}, "device must not be empty"},
+		{[]string{"-device", "/dev/ttyACM0", "-device", "/dev/ttyACM1"}, "requires -aggregate"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig(tt.args...); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestWatchdogFlag(t *testing.T) {
+	tests := []struct {
+		watchdog string
+		ok       bool
+	}{
+		{"0", true},
+		{"1ns", false},
+		{"3ns", false},
+		{"999ms", false},
+		{"1s", true},
+		{"30s", true},
+		{"-1s", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig("-device", "/dev/ttyACM0", "-watchdog", tt.watchdog); (err == nil) != tt.ok {
+			t.Errorf("-watchdog %v: error %v, want ok %v", tt.watchdog, err, tt.ok)
+		}
+	}
+}
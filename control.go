@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// errNotConnected is returned when a command is sent while no device is open
+var errNotConnected = errors.New("device is not connected")
+
+// control sends commands to the device currently opened by the reader
+type control struct {
+	mu     sync.Mutex
+	p      port
+	paused bool
+}
+
+// attach makes p the target of the commands. If the reading is paused, the
+// stream started by prepareDevice is stopped again.
+func (c *control) attach(p port) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.p = p
+	if c.paused {
+		return c.send("STP")
+	}
+	return nil
+}
+
+func (c *control) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.p = nil
+}
+
+// Pause stops the stream of readings
+func (c *control) Pause() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send("STP"); err != nil {
+		return err
+	}
+	c.paused = true
+	log.Println("Reading paused.")
+	return nil
+}
+
+// Resume restarts the stream of readings
+func (c *control) Resume() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send("STA"); err != nil {
+		return err
+	}
+	c.paused = false
+	log.Println("Reading resumed.")
+	return nil
+}
+
+// Paused reports whether the reading is paused
+func (c *control) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+func (c *control) send(cmd string) error {
+	if c.p == nil {
+		return errNotConnected
+	}
+	_, err := c.p.Write([]byte(cmd + "\r\n"))
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import "sync/atomic"
+
+// readerCounters count what the reader got from the device since startup,
+// across reconnects. They are updated by the reader and read concurrently.
+type readerCounters struct {
+	bytesRead      atomic.Uint64
+	linesRead      atomic.Uint64
+	linesMatched   atomic.Uint64 // lines matching the reading pattern, even if they failed to parse
+	linesUnmatched atomic.Uint64 // lines that are neither readings nor command responses
+	scannerErrors  atomic.Uint64
+}
+
+// readerCountersJSON is the representation of readerCounters at /info
+type readerCountersJSON struct {
+	BytesRead      uint64 `json:"bytes_read"`
+	LinesRead      uint64 `json:"lines_read"`
+	LinesMatched   uint64 `json:"lines_matched"`
+	LinesUnmatched uint64 `json:"lines_unmatched"`
+	ScannerErrors  uint64 `json:"scanner_errors"`
+}
+
+func (c *readerCounters) snapshot() readerCountersJSON {
+	return readerCountersJSON{
+		BytesRead:      c.bytesRead.Load(),
+		LinesRead:      c.linesRead.Load(),
+		LinesMatched:   c.linesMatched.Load(),
+		LinesUnmatched: c.linesUnmatched.Load(),
+		ScannerErrors:  c.scannerErrors.Load(),
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ISO8601Time utility
+type ISO8601Time time.Time
+
+// ISO8601 date time format
+const ISO8601 = `2006-01-02T15:04:05.000Z07:00`
+
+// MarshalJSON interface function
+func (t ISO8601Time) MarshalJSON() ([]byte, error) {
+	return FormattedTime{time.Time(t), timestampISO8601}.MarshalJSON()
+}
+
+// MarshalText interface function
+func (t ISO8601Time) MarshalText() ([]byte, error) {
+	return FormattedTime{time.Time(t), timestampISO8601}.MarshalText()
+}
+
+// formats of the served timestamps
+const (
+	timestampISO8601     = "iso8601"     // ISO8601 with milliseconds
+	timestampUnix        = "unix"        // seconds since the epoch as a number
+	timestampUnixMilli   = "unixmilli"   // milliseconds since the epoch as a number
+	timestampRFC3339Nano = "rfc3339nano" // RFC 3339 with nanoseconds
+)
+
+// FormattedTime is a time serialized in one of the timestamp formats
+type FormattedTime struct {
+	Time   time.Time
+	Format string
+}
+
+// MarshalJSON interface function
+func (t FormattedTime) MarshalJSON() ([]byte, error) {
+	switch t.Format {
+	case timestampUnix, timestampUnixMilli:
+		return t.MarshalText()
+	}
+	b, err := t.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(b))
+}
+
+// MarshalCBOR interface function
+func (t FormattedTime) MarshalCBOR() ([]byte, error) {
+	switch t.Format {
+	case timestampUnix:
+		return cbor.Marshal(t.Time.Unix())
+	case timestampUnixMilli:
+		return cbor.Marshal(t.Time.UnixMilli())
+	}
+	b, err := t.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(string(b))
+}
+
+// MarshalText interface function
+func (t FormattedTime) MarshalText() ([]byte, error) {
+	switch t.Format {
+	case timestampUnix:
+		return strconv.AppendInt(nil, t.Time.Unix(), 10), nil
+	case timestampUnixMilli:
+		return strconv.AppendInt(nil, t.Time.UnixMilli(), 10), nil
+	case timestampRFC3339Nano:
+		return []byte(t.Time.Format(time.RFC3339Nano)), nil
+	default:
+		return []byte(t.Time.Format(ISO8601)), nil
+	}
+}
+
+// Data - the data
+// It is never marshaled as is; clients get the view built by the encoder.
+type Data struct {
+	// ID is a time-ordered UUIDv7 identifying the reading, e.g. for deduplication
+	ID string
+
+	CO2         int64
+	Humidity    *float64
+	Temperature *float64
+	Timestamp   ISO8601Time
+
+	// IntervalSeconds is the observed interval since the previous reading
+	IntervalSeconds *float64
+
+	// CO2Compensated is the CO2 compensated for the pressure given by -pressure-hpa
+	CO2Compensated *int64
+
+	// ComfortIndex is the humidex computed from the temperature and the humidity with -comfort
+	ComfortIndex *float64
+	// ComfortLevel is the category of ComfortIndex given by -comfort-thresholds
+	ComfortLevel string
+
+	// CO2Direction is whether the CO2 is rising, falling or stable with -direction-window
+	CO2Direction string
+
+	// AfterGap marks the first reading after a gap with -mark-gaps
+	AfterGap bool
+
+	// Ventilate tells whether to ventilate given -vent-on and -vent-off
+	Ventilate *bool
+
+	// SensorSpread is the difference between the highest and the lowest CO2
+	// of the devices combined with -aggregate
+	SensorSpread *int64
+
+	// Corrections tells how the values were corrected with -include-corrections
+	Corrections *Corrections
+
+	// Location is the label of the place given by -location
+	Location string
+
+	// Seq is incremented by one for each stored reading, starting from 1
+	Seq uint64
+
+	// values as reported by the device, nil if they failed to parse
+	rawHumidity, rawTemperature *float64
+
+	// elapsed is the time of the reading on the monotonic clock since startup.
+	// Unlike Timestamp, it does not jump when the wall clock is stepped, e.g. by NTP.
+	elapsed time.Duration
+
+	// reconnected is set on the first reading after the device was reopened
+	reconnected bool
+}
+
+// startTime is the origin of Data.elapsed
+var startTime = time.Now()
+
+// age returns how long ago the reading was read, on the monotonic clock
+func (d *Data) age() time.Duration {
+	return time.Since(startTime) - d.elapsed
+}
+
+// parseData builds Data from the submatches of a reading line.
+// CO2 is mandatory; humidity and temperature are left nil when they fail to parse.
+func parseData(m []string, now time.Time, humidityBasis string) (*Data, error) {
+	co2, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CO2 %q: %w", m[1], err)
+	}
+	d := &Data{
+		CO2:       co2,
+		Timestamp: ISO8601Time(now),
+		elapsed:   now.Sub(startTime), // now carries a monotonic reading
+	}
+
+	h, herr := strconv.ParseFloat(m[2], 64)
+	if herr != nil {
+		log.Printf("Warning: invalid humidity %q: %v\n", m[2], herr)
+	} else {
+		d.rawHumidity = &h
+	}
+	t, terr := strconv.ParseFloat(m[3], 64)
+	if terr != nil {
+		log.Printf("Warning: invalid temperature %q: %v\n", m[3], terr)
+	} else {
+		d.rawTemperature = &t
+	}
+	if terr == nil {
+		ct := correctTemperature(t)
+		d.Temperature = &ct
+		// humidity correction depends on the temperature
+		if herr == nil {
+			ch := correctHumidity(h, t, humidityBasis)
+			d.Humidity = &ch
+		}
+	}
+	return d, nil
+}
+
+// Corrections are the corrections applied to a reading and the values before them
+type Corrections struct {
+	RawCO2            int64    `json:"raw_co2" xml:"raw_co2"`
+	CO2Offset         int64    `json:"co2_offset" xml:"co2_offset"`
+	CO2Clamped        bool     `json:"co2_clamped" xml:"co2_clamped"` // the offset CO2 was negative and clamped at 0
+	PressureHPa       *float64 `json:"pressure_hpa" xml:"pressure_hpa,omitempty"`
+	RawTemperature    *float64 `json:"raw_temperature" xml:"raw_temperature,omitempty"`
+	TemperatureOffset float64  `json:"temperature_offset" xml:"temperature_offset"`
+	RawHumidity       *float64 `json:"raw_humidity" xml:"raw_humidity,omitempty"`
+	HumidityBasis     string   `json:"humidity_basis" xml:"humidity_basis"`
+	HumidityCorrected bool     `json:"humidity_corrected" xml:"humidity_corrected"`
+}
+
+// temperature bases of the humidity correction
+const (
+	// the device measured the humidity at its own raw temperature
+	humidityBasisRaw = "raw"
+	// the device measured the humidity at the corrected (room) temperature
+	humidityBasisCorrected = "corrected"
+	// use the humidity as reported
+	humidityBasisNone = "none"
+)
+
+// magnus returns the saturation vapor pressure at t in units of 6.1078 hPa (Magnus-Tetens)
+func magnus(t float64) float64 {
+	return math.Pow(10.0, 7.5*t/(t+237.3))
+}
+
+// correctHumidity converts the relative humidity h reported with the raw temperature t
+// by keeping the vapor pressure. With the raw basis, h is taken as measured at t and the
+// result is h*es(t)/es(t1), the humidity at the corrected temperature t1. The corrected
+// basis applies the inverse formula h*es(t1)/es(t), which takes h as measured at t1 and
+// gives the humidity at t.
+func correctHumidity(h float64, t float64, basis string) float64 {
+	t1 := correctTemperature(t)
+	switch basis {
+	case humidityBasisCorrected:
+		return h * magnus(t1) / magnus(t)
+	case humidityBasisNone:
+		return h
+	default:
+		return h * magnus(t) / magnus(t1)
+	}
+}
+
+// standardPressure is the pressure in hPa the device is calibrated at
+const standardPressure = 1013.25
+
+// compensatePressure corrects the CO2 measured at pressure p in hPa to the standard pressure.
+// An NDIR sensor counts molecules in its optical path, which scales with the pressure.
+func compensatePressure(co2 int64, p float64) int64 {
+	return int64(math.Round(float64(co2) * standardPressure / p))
+}
+
+// temperatureOffset is subtracted from the temperature reported by the device,
+// which is warmed by its own electronics
+const temperatureOffset = 4.5
+
+func correctTemperature(t float64) float64 {
+	return t - temperatureOffset
+}
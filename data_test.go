@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// parseTimestamp parses a timestamp in format decoded from JSON or CBOR
+func parseTimestamp(format string, v any) (time.Time, error) {
+	switch format {
+	case timestampUnix, timestampUnixMilli:
+		var n int64
+		switch v := v.(type) {
+		case json.Number:
+			var err error
+			if n, err = v.Int64(); err != nil {
+				return time.Time{}, err
+			}
+		case uint64:
+			n = int64(v)
+		default:
+			return time.Time{}, fmt.Errorf("%T is not a number", v)
+		}
+		if format == timestampUnix {
+			return time.Unix(n, 0), nil
+		}
+		return time.UnixMilli(n), nil
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("%T is not a string", v)
+		}
+		layout := ISO8601
+		if format == timestampRFC3339Nano {
+			layout = time.RFC3339Nano
+		}
+		return time.Parse(layout, s)
+	}
+}
+
+func TestFormattedTimeRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.FixedZone("JST", 9*60*60))
+	tests := []struct {
+		format string
+		want   time.Time // ts at the precision of the format
+	}{
+		{timestampISO8601, ts.Truncate(time.Millisecond)},
+		{timestampRFC3339Nano, ts},
+		{timestampUnix, ts.Truncate(time.Second)},
+		{timestampUnixMilli, ts.Truncate(time.Millisecond)},
+	}
+	for _, tt := range tests {
+		ft := FormattedTime{ts, tt.format}
+
+		b, err := json.Marshal(ft)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jv any
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(&jv); err != nil {
+			t.Fatalf("%v: invalid JSON %s: %v", tt.format, b, err)
+		}
+
+		b, err = cbor.Marshal(ft)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cv any
+		if err := cbor.Unmarshal(b, &cv); err != nil {
+			t.Fatalf("%v: invalid CBOR %x: %v", tt.format, b, err)
+		}
+
+		for name, v := range map[string]any{"JSON": jv, "CBOR": cv} {
+			got, err := parseTimestamp(tt.format, v)
+			if err != nil {
+				t.Errorf("%v %v: %v", tt.format, name, err)
+			} else if !got.Equal(tt.want) {
+				t.Errorf("%v %v: got %v, want %v", tt.format, name, got, tt.want)
+			}
+		}
+	}
+}
+
+// TestCorrectHumidityREADME reproduces the worked examples of the humidity bases in the README
+func TestCorrectHumidityREADME(t *testing.T) {
+	tests := []struct {
+		line                 string
+		temperature          string
+		raw, corrected, none string
+	}{
+		{"CO2=650,HUM=45.0,TMP=27.0", "22.50", "58.86", "34.40", "45.00"},
+		{"CO2=650,HUM=60.0,TMP=30.0", "25.50", "78.01", "46.15", "60.00"},
+	}
+	for _, tt := range tests {
+		m := readingPattern.FindStringSubmatch(tt.line)
+		for basis, want := range map[string]string{
+			humidityBasisRaw:       tt.raw,
+			humidityBasisCorrected: tt.corrected,
+			humidityBasisNone:      tt.none,
+		} {
+			d, err := parseData(m, time.Now(), basis)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%.2f", *d.Humidity); got != want {
+				t.Errorf("%v with basis %v: humidity %v, want %v", tt.line, basis, got, want)
+			}
+			if got := fmt.Sprintf("%.2f", *d.Temperature); got != tt.temperature {
+				t.Errorf("%v with basis %v: temperature %v, want %v", tt.line, basis, got, tt.temperature)
+			}
+		}
+	}
+}
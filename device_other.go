@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// resolveDevice returns device as is; port names such as COM3 are not paths
+func resolveDevice(device string) (string, error) {
+	return device, nil
+}
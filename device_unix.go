@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// resolveDevice follows symlinks such as /dev/serial/by-id/... to the
+// device node they currently point at
+func resolveDevice(device string) (string, error) {
+	path, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", fmt.Errorf("device %v is not available: %w", device, err)
+	}
+	if path != device {
+		log.Printf("Resolved %v to %v\n", device, path)
+	}
+	return path, nil
+}
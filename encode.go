@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// units of the served CO2 value
+const (
+	co2UnitPPM     = "ppm"
+	co2UnitPercent = "percent"
+)
+
+// encoder renders Data according to the output options
+type encoder struct {
+	co2AsString bool
+	co2Unit     string
+	decimals    int // negative for no rounding
+
+	timestampFormat string
+}
+
+func newEncoder(cfg *config) *encoder {
+	return &encoder{
+		co2AsString: cfg.co2AsString,
+		co2Unit:     cfg.co2Unit,
+		decimals:    cfg.decimals,
+
+		timestampFormat: cfg.timestampFormat,
+	}
+}
+
+// schemaVersion identifies the fields of view. Bump it whenever a field is
+// added, removed, renamed or moved, as clients may rely on the field order.
+const schemaVersion = 8
+
+// reconnectEvent is the line written to /stream and -fifo before the first
+// reading after a reconnect, telling that readings may be missing in between
+var reconnectEvent = []byte(`{"event":"reconnect"}` + "\n")
+
+// view is the representation of Data served to clients.
+// The XML document is equivalent to the JSON one, omitting null values.
+// Fields are serialized in the order they are declared.
+type view struct {
+	XMLName         xml.Name      `json:"-" xml:"reading"`
+	SchemaVersion   int           `json:"schema_version" xml:"schema_version"`
+	ID              string        `json:"id" xml:"id"`
+	CO2             any           `json:"co2" xml:"co2"`
+	CO2Unit         string        `json:"co2_unit" xml:"co2_unit"`
+	CO2Compensated  any           `json:"co2_compensated,omitempty" xml:"co2_compensated,omitempty"`
+	Humidity        *float64      `json:"humidity" xml:"humidity,omitempty"`
+	Temperature     *float64      `json:"temperature" xml:"temperature,omitempty"`
+	Timestamp       FormattedTime `json:"timestamp" xml:"timestamp"`
+	IntervalSeconds *float64      `json:"interval_seconds" xml:"interval_seconds,omitempty"`
+	Seq             uint64        `json:"seq" xml:"seq"`
+	CO2Direction    string        `json:"co2_direction,omitempty" xml:"co2_direction,omitempty"`
+	ComfortIndex    *float64      `json:"comfort_index,omitempty" xml:"comfort_index,omitempty"`
+	ComfortLevel    string        `json:"comfort_level,omitempty" xml:"comfort_level,omitempty"`
+	AfterGap        bool          `json:"after_gap,omitempty" xml:"after_gap,omitempty"`
+	Ventilate       *bool         `json:"ventilate,omitempty" xml:"ventilate,omitempty"`
+	SensorSpread    *int64        `json:"sensor_spread,omitempty" xml:"sensor_spread,omitempty"`
+	Corrections     *Corrections  `json:"corrections,omitempty" xml:"corrections,omitempty"`
+	Stale           bool          `json:"stale,omitempty" xml:"stale,omitempty"` // older than -max-stale, with -serve-stale
+	Location        string        `json:"location,omitempty" xml:"location,omitempty"`
+}
+
+func (e *encoder) view(d *Data) *view {
+	v := &view{
+		SchemaVersion:   schemaVersion,
+		ID:              d.ID,
+		CO2:             e.co2(d.CO2),
+		CO2Unit:         e.co2Unit,
+		Humidity:        e.round(finite("humidity", d.Humidity)),
+		Temperature:     e.round(finite("temperature", d.Temperature)),
+		Timestamp:       FormattedTime{time.Time(d.Timestamp), e.timestampFormat},
+		IntervalSeconds: e.round(finite("interval_seconds", d.IntervalSeconds)),
+		Seq:             d.Seq,
+		CO2Direction:    d.CO2Direction,
+		ComfortIndex:    e.round(finite("comfort_index", d.ComfortIndex)),
+		ComfortLevel:    d.ComfortLevel,
+		AfterGap:        d.AfterGap,
+		Ventilate:       d.Ventilate,
+		SensorSpread:    d.SensorSpread,
+		Corrections:     d.Corrections,
+		Location:        d.Location,
+	}
+	if d.CO2Compensated != nil {
+		v.CO2Compensated = e.co2(*d.CO2Compensated)
+	}
+	return v
+}
+
+// co2 converts a CO2 value in ppm to the configured unit and representation
+func (e *encoder) co2(ppm int64) any {
+	switch e.co2Unit {
+	case co2UnitPercent:
+		p := float64(ppm) / 10000
+		if e.co2AsString {
+			return strconv.FormatFloat(p, 'f', -1, 64)
+		}
+		return p
+	default:
+		if e.co2AsString {
+			return strconv.FormatInt(ppm, 10)
+		}
+		return ppm
+	}
+}
+
+// finite returns f, or nil if it is NaN or infinite, which JSON cannot represent
+func finite(name string, f *float64) *float64 {
+	if f != nil && (math.IsNaN(*f) || math.IsInf(*f, 0)) {
+		log.Printf("Warning: %v is %v, serving null\n", name, *f)
+		return nil
+	}
+	return f
+}
+
+// round rounds f to the configured number of decimal places, keeping nil as is
+func (e *encoder) round(f *float64) *float64 {
+	if f == nil || e.decimals < 0 {
+		return f
+	}
+	p := math.Pow10(e.decimals)
+	r := math.Round(*f*p) / p
+	return &r
+}
+
+// JSON returns the JSON representation of d
+func (e *encoder) JSON(d *Data) ([]byte, error) {
+	return e.view(d).JSON()
+}
+
+// JSON returns the JSON representation of v
+func (v *view) JSON() ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// XML returns the XML document representing v
+func (v *view) XML() ([]byte, error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// csvColumns are the header of the CSV representation of view: the fields of
+// the JSON one in the same order, except corrections
+var csvColumns = []string{
+	"schema_version", "id", "co2", "co2_unit", "co2_compensated", "humidity", "temperature",
+	"timestamp", "interval_seconds", "seq", "co2_direction", "comfort_index", "comfort_level",
+	"after_gap", "ventilate", "sensor_spread", "stale", "location",
+}
+
+// CSV returns the header and a single row representing v, null values being empty cells
+func (v *view) CSV() ([]byte, error) {
+	ts, err := v.Timestamp.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	cell := func(x any) string {
+		switch x := x.(type) {
+		case *float64:
+			if x != nil {
+				return formatFloat(*x)
+			}
+		case *int64:
+			if x != nil {
+				return strconv.FormatInt(*x, 10)
+			}
+		case *bool:
+			if x != nil {
+				return strconv.FormatBool(*x)
+			}
+		case int64:
+			return strconv.FormatInt(x, 10)
+		case float64:
+			return formatFloat(x)
+		case string:
+			return x
+		}
+		return ""
+	}
+	row := []string{
+		strconv.Itoa(v.SchemaVersion), v.ID, cell(v.CO2), v.CO2Unit, cell(v.CO2Compensated), cell(v.Humidity), cell(v.Temperature),
+		string(ts), cell(v.IntervalSeconds), strconv.FormatUint(v.Seq, 10), v.CO2Direction, cell(v.ComfortIndex), v.ComfortLevel,
+		strconv.FormatBool(v.AfterGap), cell(v.Ventilate), cell(v.SensorSpread), strconv.FormatBool(v.Stale), v.Location,
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(csvColumns)
+	w.Write(row)
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// CBOR returns the CBOR (RFC 8949) representation of v, a map with the same keys as the JSON one
+func (v *view) CBOR() ([]byte, error) {
+	return cbor.Marshal(v)
+}
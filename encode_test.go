@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEncoderCO2(t *testing.T) {
+	tests := []struct {
+		unit     string
+		asString bool
+		ppm      int64
+		want     any
+	}{
+		{co2UnitPPM, false, 650, int64(650)},
+		{co2UnitPPM, true, 650, "650"},
+		{co2UnitPercent, false, 650, 0.065},
+		{co2UnitPercent, true, 650, "0.065"},
+		{co2UnitPercent, true, 10000, "1"},
+	}
+	for _, tt := range tests {
+		e := &encoder{co2Unit: tt.unit, co2AsString: tt.asString}
+		if got := e.co2(tt.ppm); got != tt.want {
+			t.Errorf("co2(%v) with %v, as string %v = %#v, want %#v", tt.ppm, tt.unit, tt.asString, got, tt.want)
+		}
+	}
+}
+
+func TestEncoderJSONCO2(t *testing.T) {
+	tests := []struct {
+		asString bool
+		want     string
+	}{
+		{false, `"co2":650,`},
+		{true, `"co2":"650",`},
+	}
+	for _, tt := range tests {
+		e := &encoder{co2Unit: co2UnitPPM, co2AsString: tt.asString, timestampFormat: timestampISO8601}
+		b, err := e.JSON(&Data{CO2: 650})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), tt.want) {
+			t.Errorf("JSON with as string %v = %s, want it to contain %s", tt.asString, b, tt.want)
+		}
+	}
+}
+
+func TestEncoderNonFinite(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	e := newEncoder(testConfig(t, "-device", simDevice))
+	b, err := e.JSON(&Data{CO2: 650, Humidity: &nan, Temperature: &inf, ComfortIndex: &nan})
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	for _, want := range []string{`"humidity":null`, `"temperature":null`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("JSON = %s, want it to contain %s", b, want)
+		}
+	}
+	if strings.Contains(string(b), "comfort_index") {
+		t.Errorf("JSON = %s, want no comfort_index", b)
+	}
+	if _, err := e.view(&Data{Humidity: &nan}).XML(); err != nil {
+		t.Errorf("XML failed: %v", err)
+	}
+}
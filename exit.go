@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+
+	"go.bug.st/serial"
+)
+
+// exit codes of the failures scripts may want to tell apart
+const (
+	exitFailure          = 1 // any other failure
+	exitDeviceNotFound   = 2
+	exitUsage            = 2 // as the flag package exits with on invalid flags
+	exitPermissionDenied = 3
+	exitAddrInUse        = 4
+	exitPrepareFailed    = 5
+	exitNoStream         = 6 // with -on-no-stream exit
+)
+
+// errPrepare is returned when the device did not accept the commands sent on opening it
+var errPrepare = errors.New("failed to prepare device")
+
+// errUsage is returned when the command line flags are invalid
+var errUsage = errors.New("invalid command line flags")
+
+// exitCode returns the exit code for err
+func exitCode(err error) int {
+	var pe *serial.PortError
+	isPortError := func(code serial.PortErrorCode) bool {
+		return errors.As(err, &pe) && pe.Code() == code
+	}
+	// only the device tells apart missing and forbidden files; a missing
+	// -static-dir or an unwritable -record is any other failure
+	opening := errors.Is(err, errOpen)
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case opening && (errors.Is(err, fs.ErrNotExist) || isPortError(serial.PortNotFound)):
+		return exitDeviceNotFound
+	case opening && (errors.Is(err, fs.ErrPermission) || isPortError(serial.PermissionDenied)):
+		return exitPermissionDenied
+	case errors.Is(err, syscall.EADDRINUSE):
+		return exitAddrInUse
+	case errors.Is(err, errPrepare):
+		return exitPrepareFailed
+	case errors.Is(err, errNoStream):
+		return exitNoStream
+	default:
+		return exitFailure
+	}
+}
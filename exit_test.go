@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("reader: %w: %w", errOpen, fs.ErrNotExist), exitDeviceNotFound},
+		{fmt.Errorf("reader: %w: %w", errOpen, fs.ErrPermission), exitPermissionDenied},
+		// files other than the device
+		{fmt.Errorf("reader: failed to open record file: %w", fs.ErrNotExist), exitFailure},
+		{fmt.Errorf("FIFO: %w", fs.ErrPermission), exitFailure},
+		{fmt.Errorf("%w: device is required", errUsage), exitUsage},
+		{fmt.Errorf("HTTP server: %w", syscall.EADDRINUSE), exitAddrInUse},
+		{fmt.Errorf("reader: %w: %w", errPrepare, fmt.Errorf("no response")), exitPrepareFailed},
+		{fmt.Errorf("reader: %w", errNoStream), exitNoStream},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// runFIFO fails where named pipes are not available
+func runFIFO(ctx context.Context, path string, buf int, st *state, enc *encoder) error {
+	return errors.New("FIFO is not supported on this platform")
+}
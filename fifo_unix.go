@@ -0,0 +1,103 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFIFO writes each reading as a JSON line to the named pipe at path, creating it
+// if needed, until ctx is done. The pipe is opened without blocking, so readings
+// are skipped while no process reads it or while more than buf are queued.
+func runFIFO(ctx context.Context, path string, buf int, st *state, enc *encoder) error {
+	if fi, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := unix.Mkfifo(path, 0o644); err != nil {
+			return fmt.Errorf("failed to create FIFO: %w", err)
+		}
+	} else if err != nil {
+		return err
+	} else if fi.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%v is not a FIFO", path)
+	}
+
+	c, unsubscribe := st.subs.SubscribeSink("fifo", buf)
+	defer unsubscribe()
+
+	fd := -1
+	defer func() {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}()
+	writeLine := func(b []byte) {
+		if fd < 0 {
+			// ENXIO until a reader opens the other end
+			var err error
+			if fd, err = unix.Open(path, unix.O_WRONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0); err != nil {
+				fd = -1
+				return
+			}
+		}
+		// a line up to PIPE_BUF bytes is written at once or not at all
+		if _, err := unix.Write(fd, b); err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				return // the reader is not keeping up
+			}
+			if !errors.Is(err, unix.EPIPE) {
+				log.Printf("Warning: failed to write to FIFO: %v\n", err)
+			}
+			unix.Close(fd) // reopened once a reader is back
+			fd = -1
+		}
+	}
+	write := func(d *Data) error {
+		b, err := enc.JSON(d)
+		if err != nil {
+			return err
+		}
+		if d.reconnected {
+			writeLine(reconnectEvent)
+		}
+		writeLine(append(b, '\n'))
+		return nil
+	}
+	// drain writes out the queued readings
+	drain := func() (int, error) {
+		for n := 0; ; n++ {
+			select {
+			case d := <-c:
+				if err := write(d); err != nil {
+					return n, err
+				}
+			default:
+				return n, nil
+			}
+		}
+	}
+	flushes, unregister := st.flushers.Register("fifo")
+	defer unregister()
+	for {
+		select {
+		case <-ctx.Done():
+			// the reader has stopped, write out what is left
+			_, err := drain()
+			return err
+		case reply := <-flushes:
+			n, err := drain()
+			reply <- n
+			if err != nil {
+				return err
+			}
+		case d := <-c:
+			if err := write(d); err != nil {
+				return err
+			}
+		}
+	}
+}
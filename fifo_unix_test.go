@@ -0,0 +1,62 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFIFOWritesReadingsQueuedAtShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings")
+	cfg := testConfig(t, "-device", simDevice)
+	st := newState(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- runFIFO(ctx, path, cfg.buffer, st, newEncoder(cfg))
+	}()
+	// subscribed once the FIFO is created
+	waitFor(t, "the FIFO", func() bool { return st.subs.Len() == 1 })
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	// the last readings right before the shutdown, in the order of serve:
+	// the reader stops before the sinks are
+	for i := 0; i < 3; i++ {
+		st.Update(testReading(t, testLine))
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("FIFO failed: %v", err)
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("read %q, want 3 readings", b)
+	}
+	for i, l := range lines {
+		var v struct {
+			Seq int `json:"seq"`
+		}
+		if err := json.Unmarshal([]byte(l), &v); err != nil || v.Seq != i+1 {
+			t.Errorf("line %v = %v, want seq %v", i, l, i+1)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// flushers lets POST /flush ask the sinks to write out their queued readings at once
+type flushers struct {
+	mu    sync.Mutex
+	sinks map[string]chan chan int
+}
+
+func newFlushers() *flushers {
+	return &flushers{sinks: map[string]chan chan int{}}
+}
+
+// Register returns the channel over which the sink name receives the flush requests,
+// each to be answered with the number of readings written, and a function to unregister.
+func (f *flushers) Register(name string) (<-chan chan int, func()) {
+	c := make(chan chan int)
+	f.mu.Lock()
+	f.sinks[name] = c
+	f.mu.Unlock()
+	return c, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.sinks, name)
+	}
+}
+
+// Flush asks every sink to flush and returns the number of readings each wrote.
+// A sink that does not answer until ctx is done, e.g. as it just stopped, is left out.
+func (f *flushers) Flush(ctx context.Context) map[string]int {
+	f.mu.Lock()
+	sinks := make(map[string]chan chan int, len(f.sinks))
+	for name, c := range f.sinks {
+		sinks[name] = c
+	}
+	f.mu.Unlock()
+
+	flushed := map[string]int{}
+	for name, c := range sinks {
+		reply := make(chan int, 1)
+		select {
+		case c <- reply:
+		case <-ctx.Done():
+			continue
+		}
+		select {
+		case n := <-reply:
+			flushed[name] = n
+		case <-ctx.Done():
+		}
+	}
+	return flushed
+}
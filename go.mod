@@ -3,8 +3,15 @@ module github.com/mono0x/ud-co2s-server
 go 1.21.1
 
 require (
-	github.com/creack/goselect v0.1.2 // indirect
-	go.bug.st/serial v1.6.1 // indirect
+	github.com/fxamacker/cbor/v2 v2.5.0
+	go.bug.st/serial v1.6.1
+	golang.org/x/net v0.17.0
 	golang.org/x/sync v0.3.0
-	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
+	golang.org/x/sys v0.13.0
+)
+
+require (
+	github.com/creack/goselect v0.1.2 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
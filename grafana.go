@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// grafanaTargets are the series served to the Grafana SimpleJSON datasource
+var grafanaTargets = []string{"co2", "humidity", "temperature"}
+
+// grafanaQuery is the body of /grafana/query, of which only the fields used are decoded
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+	MaxDataPoints int `json:"maxDataPoints"`
+}
+
+// grafanaSeries is a time series of /grafana/query, each datapoint being [value, unix ms]
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// handleGrafana answers the connection test of the datasource
+func (s *server) handleGrafana(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/grafana/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, grafanaTargets)
+}
+
+func (s *server) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var q grafanaQuery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.maxBodySize)).Decode(&q); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ds := s.st.history.Range(q.Range.From, q.Range.To)
+	// Grafana asks for no more points than the panel is wide
+	step := 1
+	if q.MaxDataPoints > 0 && len(ds) > q.MaxDataPoints {
+		step = (len(ds) + q.MaxDataPoints - 1) / q.MaxDataPoints
+	}
+	series := []grafanaSeries{}
+	for _, t := range q.Targets {
+		value, err := grafanaValue(t.Target)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		points := [][2]float64{}
+		for i := 0; i < len(ds); i += step {
+			if v := value(ds[i]); v != nil {
+				points = append(points, [2]float64{*v, float64(time.Time(ds[i].Timestamp).UnixMilli())})
+			}
+		}
+		series = append(series, grafanaSeries{Target: t.Target, Datapoints: points})
+	}
+	writeJSON(w, http.StatusOK, series)
+}
+
+// grafanaValue returns the function taking the value of target from a reading, nil if missing
+func grafanaValue(target string) (func(*Data) *float64, error) {
+	switch target {
+	case "co2":
+		return func(d *Data) *float64 {
+			v := float64(d.CO2)
+			return &v
+		}, nil
+	case "humidity":
+		return func(d *Data) *float64 { return finite("humidity", d.Humidity) }, nil
+	case "temperature":
+		return func(d *Data) *float64 { return finite("temperature", d.Temperature) }, nil
+	default:
+		return nil, fmt.Errorf("unknown target: %v", target)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+)
+
+// history keeps the most recent readings for -grafana-json
+type history struct {
+	data *ring[*Data]
+}
+
+func newHistory(size int) *history {
+	return &history{data: newRing[*Data](size)}
+}
+
+// Add keeps d, dropping the oldest reading if the buffer is full
+func (h *history) Add(d *Data) {
+	h.data.Add(d)
+}
+
+// Range returns the kept readings taken from from to to inclusive, oldest first
+func (h *history) Range(from, to time.Time) []*Data {
+	var ds []*Data
+	for _, d := range h.data.Values() {
+		if t := time.Time(d.Timestamp); !t.Before(from) && !t.After(to) {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
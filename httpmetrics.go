@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the request duration histogram
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpMetrics counts the requests to the HTTP server by route. Routes are the
+// registered patterns, e.g. "/" for all the static files, so that the label
+// values are bounded.
+type httpMetrics struct {
+	mu     sync.Mutex
+	routes map[string]*routeMetrics
+}
+
+type routeMetrics struct {
+	codes   map[int]uint64
+	buckets []uint64 // requests per bucket, the last one for +Inf
+	sum     float64
+	count   uint64
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{routes: map[string]*routeMetrics{}}
+}
+
+// instrument counts the requests handled by h under route
+func (m *httpMetrics) instrument(route string, h http.Handler) http.Handler {
+	m.mu.Lock()
+	rm := &routeMetrics{codes: map[int]uint64{}, buckets: make([]uint64, len(durationBuckets)+1)}
+	m.routes[route] = rm
+	m.mu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		d := time.Since(start).Seconds()
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		rm.codes[sw.code]++
+		i, _ := slices.BinarySearch(durationBuckets, d)
+		rm.buckets[i]++
+		rm.sum += d
+		rm.count++
+	})
+}
+
+// write writes the request counters and the duration histograms to w
+func (m *httpMetrics) write(w *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes := make([]string, 0, len(m.routes))
+	for r := range m.routes {
+		routes = append(routes, r)
+	}
+	slices.Sort(routes)
+
+	family := "udco2s_http_requests"
+	if !w.om {
+		family += "_total"
+	}
+	w.family(family, "counter", "HTTP requests handled by route and status code.")
+	for _, r := range routes {
+		codes := make([]int, 0, len(m.routes[r].codes))
+		for c := range m.routes[r].codes {
+			codes = append(codes, c)
+		}
+		slices.Sort(codes)
+		for _, c := range codes {
+			w.sample("udco2s_http_requests_total", float64(m.routes[r].codes[c]), "route", r, "code", strconv.Itoa(c))
+		}
+	}
+
+	w.family("udco2s_http_request_duration_seconds", "histogram", "Time taken to handle HTTP requests by route.")
+	for _, r := range routes {
+		rm := m.routes[r]
+		var n uint64
+		for i, b := range durationBuckets {
+			n += rm.buckets[i]
+			w.sample("udco2s_http_request_duration_seconds_bucket", float64(n), "route", r, "le", formatFloat(b))
+		}
+		w.sample("udco2s_http_request_duration_seconds_bucket", float64(rm.count), "route", r, "le", "+Inf")
+		w.sample("udco2s_http_request_duration_seconds_sum", rm.sum, "route", r)
+		w.sample("udco2s_http_request_duration_seconds_count", float64(rm.count), "route", r)
+	}
+}
+
+// statusWriter records the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the flusher of the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
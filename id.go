@@ -0,0 +1,62 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// idGenerator generates time-ordered UUIDv7 (RFC 9562) reading IDs
+type idGenerator struct {
+	rand   io.Reader
+	lastMS int64
+	seq    uint16 // 12-bit counter keeping the IDs ordered within a millisecond
+}
+
+// newIDGenerator returns a generator drawing random bits from crypto/rand,
+// or from a source seeded with seed for the simulated device so that its
+// IDs are reproducible apart from the timestamp
+func newIDGenerator(cfg *config) *idGenerator {
+	if cfg.device == simDevice {
+		return &idGenerator{rand: rand.New(rand.NewSource(cfg.simSeed))}
+	}
+	return &idGenerator{rand: crand.Reader}
+}
+
+// New returns the ID of a reading at t, greater than the previous one even if
+// the clock went back. It is not safe for concurrent use.
+func (g *idGenerator) New(t time.Time) string {
+	var b [16]byte
+	g.rand.Read(b[6:])
+
+	ms := t.UnixMilli()
+	if ms > g.lastMS {
+		g.lastMS = ms
+		g.seq = binary.BigEndian.Uint16(b[6:8]) & 0x7ff // leave room to count up
+	} else if g.seq < 0xfff {
+		g.seq++
+	} else {
+		// the counter is exhausted, e.g. long after the clock was stepped
+		// back, so move on to the next millisecond rather than wrap around
+		g.lastMS++
+		g.seq = 0
+	}
+	binary.BigEndian.PutUint64(b[:8], uint64(g.lastMS)<<16|uint64(g.seq))
+	b[6] = 0x70 | b[6]&0x0f // version 7
+	b[8] = 0x80 | b[8]&0x3f // variant 10
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
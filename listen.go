@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// listen listens on addr, or if its port is in use, on the first free one of
+// the following fallback ports
+func listen(ctx context.Context, lc net.ListenConfig, addr string, fallback int) (net.Listener, error) {
+	l, err := lc.Listen(ctx, "tcp", addr)
+	if err == nil || fallback <= 0 || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+	host, p, serr := net.SplitHostPort(addr)
+	if serr != nil {
+		return nil, err
+	}
+	port, serr := strconv.Atoi(p)
+	if serr != nil || port == 0 {
+		return nil, err // a named or random port has no following ports
+	}
+	for i := 1; i <= fallback && port+i <= 65535; i++ {
+		a := net.JoinHostPort(host, strconv.Itoa(port+i))
+		l, ferr := lc.Listen(ctx, "tcp", a)
+		if ferr == nil {
+			log.Printf("Warning: %v is in use, listening on %v instead\n", addr, a)
+			return l, nil
+		}
+		if !errors.Is(ferr, syscall.EADDRINUSE) {
+			return nil, ferr
+		}
+	}
+	return nil, err
+}
+
+// resolveListenAddr replaces the host part of addr with the address given by
+// listenNet, which is either an IP address or an interface name.
+func resolveListenAddr(addr, listenNet string) (string, error) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid addr: %w", err)
+	}
+
+	if ip := net.ParseIP(listenNet); ip != nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return "", fmt.Errorf("failed to list interface addresses: %w", err)
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return net.JoinHostPort(ip.String(), p), nil
+			}
+		}
+		return "", fmt.Errorf("address %v is not assigned to any interface", listenNet)
+	}
+
+	iface, err := net.InterfaceByName(listenNet)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen net %q: %w", listenNet, err)
+	}
+	ifaddrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list addresses of %v: %w", listenNet, err)
+	}
+	// prefer IPv4 since it is the common case for LAN clients
+	var found net.IP
+	for _, a := range ifaddrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if n.IP.To4() != nil {
+			found = n.IP
+			break
+		}
+		if found == nil && !n.IP.IsLinkLocalUnicast() {
+			found = n.IP
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("interface %v has no usable address", listenNet)
+	}
+	return net.JoinHostPort(found.String(), p), nil
+}
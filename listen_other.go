@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "syscall"
+
+// reuseAddrControl is a no-op where SO_REUSEADDR/SO_REUSEPORT are not available
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -1,205 +1,348 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math"
-	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"go.bug.st/serial"
 	"golang.org/x/sync/errgroup"
 )
 
-// ISO8601Time utility
-type ISO8601Time time.Time
+const usage = `Usage: %[1]v [command] [flags]
 
-// ISO8601 date time format
-const ISO8601 = `2006-01-02T15:04:05.000Z07:00`
+Commands:
+  serve         read the device and serve the readings over HTTP (default)
+  once          read a single reading and print it as JSON
+  list-devices  list the available serial ports
+  replay        serve the readings replayed from a file captured from the device
 
-// MarshalJSON interface function
-func (t ISO8601Time) MarshalJSON() ([]byte, error) {
-	return json.Marshal(time.Time(t).Format(ISO8601))
+Run '%[1]v <command> -h' for the flags of each command.
+`
+
+func deviceFlags(fs *flag.FlagSet, cfg *config) {
+	fs.Var(&cfg.devices, "device", "device to use (\"sim\" for a simulated device)")
+	fs.BoolVar(&cfg.autoBaud, "auto-baud", false, "probe the common baud rates for one the device answers at instead of assuming 115200")
+	fs.StringVar(&cfg.aggregate, "aggregate", aggregateNone, "combine the readings of multiple -device into one (mean)")
+	fs.DurationVar(&cfg.aggregateMaxAge, "aggregate-max-age", 30*time.Second, "age after which the reading of a device is left out of the combined one")
+	fs.DurationVar(&cfg.simInterval, "sim-interval", time.Second, "interval between simulated readings")
+	fs.Int64Var(&cfg.simSeed, "sim-seed", 0, "random seed for the simulated device (0: seeded from the clock)")
 }
 
-// Data - the data
-type Data struct {
-	CO2         int64       `json:"co2"`
-	Humidity    float64     `json:"humidity"`
-	Temperature float64     `json:"temperature"`
-	Timestamp   ISO8601Time `json:"timestamp"`
+func readerFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.lineEnding, "line-ending", lineEndingCRLF, "line ending of the device (crlf, lf or cr)")
+	fs.Int64Var(&cfg.co2Offset, "co2-offset", 0, "ppm added to the CO2 reported by the device to calibrate drift (may be negative)")
+	fs.StringVar(&cfg.humidityBasis, "humidity-basis", humidityBasisRaw, "conversion of the humidity: raw converts it from the raw to the corrected temperature, corrected applies the inverse formula, none serves it as reported")
+	fs.Float64Var(&cfg.pressure, "pressure-hpa", 0, "local air pressure in hPa to compensate the CO2 for (0: no compensation)")
+	fs.BoolVar(&cfg.includeCorrections, "include-corrections", false, "attach the applied corrections and the values reported by the device as corrections")
+	fs.BoolVar(&cfg.comfort, "comfort", false, "attach the humidex as comfort_index and its category as comfort_level to the readings")
+	fs.StringVar(&cfg.comfortThresholds, "comfort-thresholds", defaultComfortThresholds, "increasing humidex values at which some_discomfort, great_discomfort and dangerous start")
+	fs.Int64Var(&cfg.ventOn, "vent-on", 0, "CO2 ppm at or above which ventilate turns true (0: disabled)")
+	fs.Int64Var(&cfg.ventOff, "vent-off", 0, "CO2 ppm below which ventilate turns false again, below -vent-on")
+	fs.BoolVar(&cfg.plausibility, "plausibility", false, "skip readings with implausible values, logging them")
+	fs.StringVar(&cfg.co2Range, "co2-range", defaultCO2Range, "plausible CO2 ppm reported by the device as min,max, with -plausibility")
+	fs.StringVar(&cfg.temperatureRange, "temperature-range", defaultTemperatureRange, "plausible temperature in °C as min,max, with -plausibility")
+	fs.StringVar(&cfg.humidityRange, "humidity-range", defaultHumidityRange, "plausible humidity in % as min,max, with -plausibility")
+	fs.Float64Var(&cfg.maxTemperatureStep, "max-temperature-step", 5, "plausible change of the temperature in °C between readings, with -plausibility (0: unchecked)")
+	fs.Float64Var(&cfg.maxHumidityStep, "max-humidity-step", 20, "plausible change of the humidity in % between readings, with -plausibility (0: unchecked)")
+	fs.DurationVar(&cfg.directionWindow, "direction-window", 0, "window of the readings whose slope tells co2_direction (0: disabled)")
+	fs.Float64Var(&cfg.directionDeadband, "direction-deadband", 10, "CO2 slope in ppm per minute within which co2_direction is stable")
+	fs.Float64Var(&cfg.gapFactor, "gap-factor", 3, "times the usual interval after which the time between readings counts as a gap (0: disabled)")
+	fs.BoolVar(&cfg.markGaps, "mark-gaps", false, "mark the first reading after a gap with after_gap")
+	fs.StringVar(&cfg.record, "record", "", "file to record the raw lines read from the device to, for replay")
+	fs.Int64Var(&cfg.recordMaxSize, "record-max-size", 10<<20, "size in bytes at which the record file is rotated (0: unlimited)")
+	fs.StringVar(&cfg.location, "location", "", "label of the place attached to the readings as location")
+	fs.DurationVar(&cfg.watchdog, "watchdog", 0, "probe the device after this long without a reading and reconnect if it does not respond (0: disabled, else at least 1s)")
+	fs.DurationVar(&cfg.reconnectDelay, "reconnect-delay", 5*time.Second, "delay before reconnecting to a device that stopped responding")
+	fs.DurationVar(&cfg.prepareTimeout, "prepare-timeout", 5*time.Second, "time within which the device must answer each command sent when opening it (0: wait forever)")
+	fs.DurationVar(&cfg.streamTimeout, "stream-timeout", 30*time.Second, "time after STA within which the first reading must arrive (0: wait forever)")
+	fs.StringVar(&cfg.onNoStream, "on-no-stream", noStreamRetry, "action when no reading arrives within -stream-timeout (retry or exit)")
+	fs.DurationVar(&cfg.stopDrain, "stop-drain", time.Second, "time to wait for the device to acknowledge STP when closing it")
+	fs.StringVar(&cfg.onParseErrors, "on-parse-errors", parseErrorsWarn, "action when too many recent lines fail to parse (ignore, warn or exit)")
+	fs.Float64Var(&cfg.parseErrorThreshold, "parse-error-threshold", 0.5, "ratio of recent lines failing to parse that triggers -on-parse-errors")
+	fs.IntVar(&cfg.parseWindow, "parse-window", 100, "number of recent lines used for the parse success ratio")
+	fs.IntVar(&cfg.unmatchedLines, "unmatched-lines", 20, "number of recent unmatched lines kept for /debug/unmatched")
 }
 
-func prepareDevice(ctx context.Context, p serial.Port, s *bufio.Scanner) error {
-	log.Println("Prepare device...:")
-	for _, c := range []string{"STP", "ID?", "STA"} {
-		log.Printf(" %v", c)
-		if _, err := p.Write([]byte(c + "\r\n")); err != nil {
-			return err
-		}
-		time.Sleep(time.Millisecond * 100) // wait
-		for s.Scan() {
-			select {
-			case <-ctx.Done():
-				return errors.New("context canceled")
-			default:
-				// do nothing
-			}
-			t := s.Text()
-			if t[:2] == `OK` {
-				break
-			} else if t[:2] == `NG` {
-				return fmt.Errorf(" command `%v` failed", c)
-			}
-		}
-	}
-	log.Println(" OK.")
-	return nil
+func outputFlags(fs *flag.FlagSet, cfg *config) {
+	fs.BoolVar(&cfg.co2AsString, "co2-as-string", false, "serialize co2 as a JSON string")
+	fs.StringVar(&cfg.co2Unit, "co2-unit", co2UnitPPM, "unit of the served co2 value (ppm or percent)")
+	fs.StringVar(&cfg.timestampFormat, "timestamp-format", timestampISO8601, "format of the served timestamp (iso8601, unix, unixmilli or rfc3339nano)")
+	fs.IntVar(&cfg.decimals, "decimals", 2, "decimal places of the served float values (negative: no rounding)")
+}
+
+func serverFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.addr, "addr", "localhost:8080", "address to listen on")
+	fs.IntVar(&cfg.addrFallback, "addr-fallback", 0, "number of following ports to try when the port of -addr is in use (0: fail)")
+	fs.StringVar(&cfg.listenNet, "listen-net", "", "interface name or IP address to bind to, replacing the host of -addr")
+	fs.StringVar(&cfg.staticDir, "static-dir", "", "directory of static files served at /")
+	fs.StringVar(&cfg.fifo, "fifo", "", "named pipe to write each reading to as a JSON line, created if needed")
+	fs.StringVar(&cfg.redisAddr, "redis-addr", "", "host:port of a Redis server to write each reading to as JSON")
+	fs.StringVar(&cfg.redisPassword, "redis-password", "", "password of the Redis server")
+	fs.StringVar(&cfg.redisKey, "redis-key", "", "Redis key set to the latest reading")
+	fs.DurationVar(&cfg.redisTTL, "redis-ttl", 0, "expiry of -redis-key (0: never)")
+	fs.StringVar(&cfg.redisChannel, "redis-channel", "", "Redis channel each reading is published to")
+	fs.DurationVar(&cfg.exportMinInterval, "export-min-interval", 0, "minimum interval between writes to Redis, coalescing the readings in between into the latest (0: write each)")
+	fs.IntVar(&cfg.buffer, "buffer", 16, "size of the queue of readings of each subscriber, i.e. of every /stream client, -fifo and Redis, not shared among them; a subscriber skips readings while its queue is full (0: only while it is waiting)")
+	fs.BoolVar(&cfg.grafanaJSON, "grafana-json", false, "serve a Grafana SimpleJSON datasource at /grafana/ from the readings kept in memory")
+	fs.IntVar(&cfg.grafanaHistory, "grafana-history", 3600, "number of readings kept in memory for -grafana-json")
+	fs.BoolVar(&cfg.noHTTP, "no-http", false, "do not start the HTTP server, only writing the readings to -fifo or Redis")
+	fs.StringVar(&cfg.authToken, "auth-token", "", "bearer token required by the admin endpoints, which are disabled when empty")
+	fs.Int64Var(&cfg.maxBodySize, "max-body-size", 64<<10, "maximum size in bytes of the request body of the admin endpoints")
+	fs.BoolVar(&cfg.reuseAddr, "reuse-addr", false, "set SO_REUSEADDR/SO_REUSEPORT on the listener for fast restarts")
+	fs.BoolVar(&cfg.httpKeepAlive, "http-keepalive", true, "reuse HTTP connections; set false for clients such as the ESP8266 that misbehave with keep-alive")
+	fs.StringVar(&cfg.format, "format", formatJSON, "representation of /data for clients not asking for one with Accept (json, xml, cbor, csv or prometheus)")
+	fs.BoolVar(&cfg.serveStale, "serve-stale", false, "serve readings older than -max-stale with 200, X-Stale: true and stale instead of 503")
+	fs.BoolVar(&cfg.h2c, "h2c", false, "serve HTTP/2 over cleartext (h2c) in addition to HTTP/1.1")
+	fs.DurationVar(&cfg.maxStale, "max-stale", 0, "age after which /data responds 503 instead of the latest reading (0: never)")
+	fs.Uint64Var(&cfg.maxReadings, "max-readings", 0, "shut down cleanly after this many readings (0: unlimited)")
+	fs.DurationVar(&cfg.statsInterval, "stats-interval", 0, "interval of a log line summarizing the readings and the process (0: disabled)")
+	fs.Int64Var(&cfg.homeKitThreshold, "homekit-threshold", 1000, "CO2 ppm at or above which /homekit reports co2_detected")
 }
 
-func correctHumidity(h float64, t float64) float64 {
-	t1 := correctTemperature(t)
-	return h *
-		math.Pow(10.0, 7.5*t/(t+237.3)) /
-		math.Pow(10.0, 7.5*t1/(t1+237.3))
+func runtimeFlags(fs *flag.FlagSet, cfg *config) {
+	fs.IntVar(&cfg.gomaxprocs, "gomaxprocs", 0, "maximum number of CPUs executing simultaneously (0: the runtime default, capped by the CPU quota of the container)")
+	fs.Int64Var(&cfg.maxMemory, "max-memory", 0, "soft memory limit in bytes, lowering the buffer sizes to fit (0: unlimited)")
 }
 
-func correctTemperature(t float64) float64 {
-	return t - 4.5
+func profileFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.profileCPU, "profile-cpu", "", "file to write a CPU profile to")
+	fs.DurationVar(&cfg.profileCPUDuration, "profile-cpu-duration", 30*time.Second, "duration of the CPU profile (0: until exit)")
+	fs.StringVar(&cfg.profileMem, "profile-mem", "", "file to write a heap profile to on exit")
 }
 
 func run() error {
-	var device string
-	flag.StringVar(&device, "device", "", "device to use")
-	flag.Parse()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	cfg := &config{}
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	switch cmd {
+	case "serve":
+		deviceFlags(fs, cfg)
+		readerFlags(fs, cfg)
+		outputFlags(fs, cfg)
+		serverFlags(fs, cfg)
+		runtimeFlags(fs, cfg)
+		profileFlags(fs, cfg)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), usage, os.Args[0])
+			fmt.Fprintln(fs.Output(), "\nFlags of serve:")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args)
+		return serve(cfg)
+
+	case "once":
+		deviceFlags(fs, cfg)
+		readerFlags(fs, cfg)
+		outputFlags(fs, cfg)
+		timeout := fs.Duration("timeout", 30*time.Second, "time to wait for a reading")
+		fs.Parse(args)
+		return once(cfg, *timeout)
+
+	case "list-devices":
+		fs.Parse(args)
+		return listDevices()
+
+	case "replay":
+		readerFlags(fs, cfg)
+		outputFlags(fs, cfg)
+		serverFlags(fs, cfg)
+		runtimeFlags(fs, cfg)
+		profileFlags(fs, cfg)
+		fs.DurationVar(&cfg.simInterval, "replay-interval", time.Second, "interval between replayed lines")
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: %v replay [flags] <file>\n\nFlags of replay:\n", os.Args[0])
+			fs.PrintDefaults()
+		}
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		cfg.devices = deviceList{fs.Arg(0)}
+		cfg.replay = true
+		return serve(cfg)
+
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+		return nil
+	}
+}
+
+// serve reads the device and serves the readings over HTTP until SIGINT
+func serve(cfg *config) error {
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	tuneRuntime(cfg)
+	cfg.logSummary()
 
-	if device == "" {
-		return errors.New("device is required")
+	stopProfiles, err := startProfiles(cfg)
+	if err != nil {
+		return err
 	}
+	defer stopProfiles()
 
 	// trap SIGINT
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	var latest *Data = nil
+	st := newState(cfg)
 
 	eg := errgroup.Group{}
-	eg.Go(func() error {
-		port, err := serial.Open(device, &serial.Mode{
-			BaudRate: 115200,
-			DataBits: 8,
-			StopBits: serial.OneStopBit,
-			Parity:   serial.NoParity,
+	var (
+		errsMu sync.Mutex
+		errs   []error
+	)
+	// each goroutine records its own terminal error so that a failure of one
+	// is not hidden behind the other; main logs them all on exit
+	goLogged := func(name string, f func() error) {
+		eg.Go(func() error {
+			err := f()
+			if err != nil {
+				errsMu.Lock()
+				errs = append(errs, fmt.Errorf("%v: %w", name, err))
+				errsMu.Unlock()
+			}
+			return err
 		})
-		if err != nil {
-			return fmt.Errorf("failed to open port: %w", err)
-		}
-		defer func() {
-			port.Write([]byte("STP\r\n"))
-			time.Sleep(100 * time.Millisecond)
-			port.Close()
-		}()
-
-		port.SetReadTimeout(time.Second * 10)
-		s := bufio.NewScanner(port)
-		s.Split(bufio.ScanLines)
+	}
+	// on shutdown, the reader stops first, then the sinks write out the
+	// readings still queued, and the HTTP server keeps answering until the end
+	sinkCtx, stopSinks := context.WithCancel(context.Background())
+	defer stopSinks()
+	httpCtx, stopHTTP := context.WithCancel(context.Background())
+	defer stopHTTP()
+	readerDone := make(chan struct{})
+	var sinks sync.WaitGroup
 
-		if err := prepareDevice(ctx, port, s); err != nil {
-			return err
+	goLogged("reader", func() error {
+		defer close(readerDone)
+		err := runReader(ctx, cfg, st)
+		if err != nil {
+			stop() // the reader gave up, so exit with the code telling why
+		} else if cfg.maxReadings > 0 && st.Seq() >= cfg.maxReadings {
+			stop() // the reading limit was reached, exit 0
+		} else if cfg.noHTTP {
+			stop() // nothing is left to do but writing out the sinks
 		}
-
-		// reader (main)
-		re := regexp.MustCompile(`CO2=(\d+),HUM=([0-9\.]+),TMP=([0-9\.-]+)`)
-	scan:
-		for s.Scan() {
-			select {
-			case <-ctx.Done():
-				break scan
-			default:
-				// do nothing
-			}
-			now := time.Now()
-			text := s.Text()
-			m := re.FindAllStringSubmatch(text, -1)
-			if len(m) > 0 {
-				co2, _ := strconv.ParseInt(m[0][1], 10, 64)
-				h, _ := strconv.ParseFloat(m[0][2], 64)
-				t, _ := strconv.ParseFloat(m[0][3], 64)
-				latest = &Data{
-					CO2:         co2,
-					Humidity:    correctHumidity(h, t),
-					Temperature: correctTemperature(t),
-					Timestamp:   ISO8601Time(now),
-				}
-			} else if text[:6] == `OK STP` {
-				break // exit 0
-			} else {
-				log.Printf("Read unmatched string: %v\n", text)
+		return err
+	})
+	if cfg.fifo != "" {
+		sinks.Add(1)
+		goLogged("FIFO", func() error {
+			defer sinks.Done()
+			return runFIFO(sinkCtx, cfg.fifo, cfg.buffer, st, newEncoder(cfg))
+		})
+	}
+	if cfg.redisAddr != "" {
+		sinks.Add(1)
+		goLogged("Redis", func() error {
+			defer sinks.Done()
+			return runRedis(sinkCtx, cfg, st, newEncoder(cfg))
+		})
+	}
+	if !cfg.noHTTP {
+		goLogged("HTTP server", func() error {
+			err := runServer(httpCtx, cfg, st)
+			if err != nil {
+				stop() // nothing is served, e.g. the address is in use
 			}
-		}
-		if err := s.Err(); err != nil {
-			return fmt.Errorf("scanner error: %w", err)
-		}
-
-		log.Println("Reader stopped.")
-
+			return err
+		})
+	}
+	if cfg.statsInterval > 0 {
+		eg.Go(func() error {
+			runStats(httpCtx, cfg.statsInterval, st)
+			return nil
+		})
+	}
+	eg.Go(func() error {
+		<-ctx.Done()
+		<-readerDone
+		stopSinks()
+		sinks.Wait()
+		stopHTTP()
 		return nil
 	})
 
-	eg.Go(func() error {
-		mux := http.NewServeMux()
-
-		mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
-			if latest == nil {
-				http.Error(w, "no data", http.StatusServiceUnavailable)
-				return
-			}
+	eg.Wait()
+	return errors.Join(errs...)
+}
 
-			b, err := json.Marshal(latest)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// once prints the first reading of the device as JSON
+func once(cfg *config, timeout time.Duration) error {
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write(b)
-		})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-		s := &http.Server{
-			Addr:    "localhost:8080",
-			Handler: mux,
-		}
+	st := newState(cfg)
+	c, unsubscribe := st.subs.Subscribe(1)
+	defer unsubscribe()
 
-		go func() {
-			<-ctx.Done()
-			log.Println("Shutting down HTTP server...")
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			s.Shutdown(ctx)
-			log.Println("HTTP server stopped.")
-		}()
+	done := make(chan error, 1)
+	go func() {
+		done <- runReader(ctx, cfg, st)
+	}()
 
-		if err := s.ListenAndServe(); err != http.ErrServerClosed {
-			return err
+	var d *Data
+	select {
+	case d = <-c:
+	case err := <-done:
+		if err == nil {
+			err = errors.New("reader stopped without a reading")
 		}
-		return nil
-	})
+		return err
+	case <-ctx.Done():
+	}
+	cancel()
+	if err := <-done; err != nil {
+		return err
+	}
+	if d == nil {
+		return errors.New("no reading within the timeout")
+	}
 
-	return eg.Wait()
+	b, err := newEncoder(cfg).JSON(d)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// listDevices prints the available serial ports
+func listDevices() error {
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		fmt.Println(p)
+	}
+	return nil
 }
 
 func main() {
 	if err := run(); err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// content types of the metrics exposition formats
+const (
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// metricsWriter writes metrics in the Prometheus text format, or OpenMetrics when om is set
+type metricsWriter struct {
+	w      io.Writer
+	om     bool
+	ls     []string // common labels, formatted
+	labels string
+}
+
+func newMetricsWriter(w io.Writer, om bool, labels map[string]string) *metricsWriter {
+	var ls []string
+	for k, v := range labels {
+		if v != "" {
+			ls = append(ls, formatLabel(k, v))
+		}
+	}
+	sort.Strings(ls)
+	return &metricsWriter{w: w, om: om, ls: ls, labels: joinLabels(ls)}
+}
+
+func formatLabel(k, v string) string {
+	return fmt.Sprintf("%v=%v", k, strconv.Quote(v))
+}
+
+func joinLabels(ls []string) string {
+	if len(ls) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+// family writes the header of a metric family whose samples are written with sample
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// sample writes a sample with the common labels and the label pairs kv
+func (m *metricsWriter) sample(name string, v float64, kv ...string) {
+	ls := append([]string{}, m.ls...)
+	for i := 0; i+1 < len(kv); i += 2 {
+		ls = append(ls, formatLabel(kv[i], kv[i+1]))
+	}
+	fmt.Fprintf(m.w, "%v%v %v\n", name, joinLabels(ls), formatFloat(v))
+}
+
+func (m *metricsWriter) gauge(name, help string, v float64) {
+	fmt.Fprintf(m.w, "# HELP %v %v\n# TYPE %v gauge\n%v%v %v\n", name, help, name, name, m.labels, formatFloat(v))
+}
+
+// counter writes a counter; name must not have the _total suffix, which is added to the sample
+func (m *metricsWriter) counter(name, help string, v float64) {
+	family := name
+	if !m.om {
+		family = name + "_total"
+	}
+	fmt.Fprintf(m.w, "# HELP %v %v\n# TYPE %v counter\n%v_total%v %v\n", family, help, family, name, m.labels, formatFloat(v))
+}
+
+func (m *metricsWriter) end() {
+	if m.om {
+		fmt.Fprintln(m.w, "# EOF")
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// newMetricsWriter returns a metrics writer with the labels of the server
+func (s *server) newMetricsWriter(w io.Writer, om bool) *metricsWriter {
+	return newMetricsWriter(w, om, map[string]string{"location": s.cfg.location, "device_id": s.st.DeviceID()})
+}
+
+// writeReadingMetrics writes the gauges of the reading d, served by /metrics
+// and by /data in the Prometheus format
+func writeReadingMetrics(m *metricsWriter, d *Data) {
+	m.gauge("udco2s_co2_ppm", "CO2 concentration in ppm.", float64(d.CO2))
+	if d.Humidity != nil {
+		m.gauge("udco2s_humidity_percent", "Relative humidity in percent.", *d.Humidity)
+	}
+	if d.Temperature != nil {
+		m.gauge("udco2s_temperature_celsius", "Temperature in degrees Celsius.", *d.Temperature)
+	}
+	m.gauge("udco2s_last_reading_timestamp_seconds", "Time of the latest reading.", float64(time.Time(d.Timestamp).UnixMilli())/1000)
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	ct := negotiate(r, "text/plain", "application/openmetrics-text")
+	if ct == "" {
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return
+	}
+	om := ct == "application/openmetrics-text"
+	if om {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypePrometheus)
+	}
+	w.Header().Set("Vary", "Accept")
+
+	m := s.newMetricsWriter(w, om)
+	if s.st.Status() == statusRunning {
+		writeReadingMetrics(m, s.st.Latest())
+	}
+	m.counter("udco2s_readings", "Readings stored since startup.", float64(s.st.Seq()))
+	if ratio, _ := s.st.parse.Ratio(); ratio >= 0 {
+		m.gauge("udco2s_parse_success_ratio", "Ratio of recent lines parsed as readings.", ratio)
+	}
+	c := s.st.counters.snapshot()
+	m.counter("udco2s_serial_read_bytes", "Bytes read from the device since startup.", float64(c.BytesRead))
+	m.counter("udco2s_lines_read", "Lines read from the device since startup.", float64(c.LinesRead))
+	m.counter("udco2s_lines_matched", "Lines read matching the reading pattern since startup.", float64(c.LinesMatched))
+	m.counter("udco2s_lines_unmatched", "Lines read that were neither readings nor command responses since startup.", float64(c.LinesUnmatched))
+	m.counter("udco2s_scanner_errors", "Errors reading lines from the device since startup.", float64(c.ScannerErrors))
+	m.gauge("udco2s_stream_subscribers", "Consumers of the readings, i.e. /stream clients and -fifo.", float64(s.st.subs.Len()))
+	if queues := s.st.subs.Queues(); len(queues) > 0 {
+		sinks := make([]string, 0, len(queues))
+		for name := range queues {
+			sinks = append(sinks, name)
+		}
+		sort.Strings(sinks)
+		m.family("udco2s_sink_queue_length", "gauge", "Readings waiting to be written by each sink, i.e. -fifo and Redis.")
+		for _, name := range sinks {
+			m.sample("udco2s_sink_queue_length", float64(queues[name]), "sink", name)
+		}
+	}
+	s.http.write(m)
+	m.end()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// negotiate returns the offered media type that best matches the Accept header of r.
+// The first offer is the default when the header is missing; "" means none is acceptable.
+// Each offer gets the q of the most specific range matching it (RFC 9110), so that
+// "application/json;q=0, */*" excludes JSON, and ties go to the earlier offer.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		mt string
+		q  float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mt, q})
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, rg := range ranges {
+			if s := matchMediaType(rg.mt, offer); s > specificity {
+				q, specificity = rg.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// matchMediaType returns how specifically the range pattern matches mt:
+// 2 for the type itself, 1 for type/*, 0 for */* and -1 if it does not match
+func matchMediaType(pattern, mt string) int {
+	switch {
+	case pattern == mt:
+		return 2
+	case pattern == "*/*":
+		return 0
+	}
+	typ, _, _ := strings.Cut(mt, "/")
+	if strings.HasSuffix(pattern, "/*") && strings.TrimSuffix(pattern, "/*") == typ {
+		return 1
+	}
+	return -1
+}
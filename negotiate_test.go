@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDataFormatAndAccept(t *testing.T) {
+	defaults := map[string]string{
+		formatJSON:       "application/json",
+		formatXML:        "application/xml",
+		formatCBOR:       "application/cbor",
+		formatCSV:        "text/csv",
+		formatPrometheus: "text/plain",
+	}
+	// accept maps to the negotiated media type, "default" standing for the one of
+	// -format, and "default application" for it if it is an application type,
+	// or JSON, the first of them, otherwise
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "default"},
+		{"*/*", "default"},
+		{"application/*", "default application"},
+		{"application/json", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/xml", "text/xml"},
+		{"application/cbor", "application/cbor"},
+		{"text/csv", "text/csv"},
+		{"text/plain", "text/plain"},
+		{"text/plain;version=0.0.4;q=0.5, */*;q=0.1", "text/plain"},
+		{"application/xml;q=0.5, application/json", "application/json"},
+		{"application/json;q=0.1, application/cbor;q=0.9", "application/cbor"},
+		{"image/png", ""},
+	}
+	for format, def := range defaults {
+		offers := dataOffers(format)
+		for _, tt := range tests {
+			want := tt.want
+			switch want {
+			case "default":
+				want = def
+			case "default application":
+				want = "application/json"
+				if strings.HasPrefix(def, "application/") {
+					want = def
+				}
+			}
+			r := httptest.NewRequest(http.MethodGet, "/data", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if got := negotiate(r, offers...); got != want {
+				t.Errorf("-format %v, Accept %q: %q, want %q", format, tt.accept, got, want)
+			}
+		}
+	}
+}
+
+func TestDataFormatDefault(t *testing.T) {
+	cfg := testConfig(t, "-device", simDevice, "-format", formatXML)
+	st := newState(cfg)
+	h := newServer(context.Background(), cfg, st).handler()
+	st.Update(testReading(t, testLine))
+
+	for accept, want := range map[string]string{
+		"":                 "application/xml",
+		"application/json": "application/json",
+	} {
+		if ct := get(t, h, "/data", accept).Header().Get("Content-Type"); ct != want {
+			t.Errorf("Accept %q: Content-Type %v, want %v", accept, ct, want)
+		}
+	}
+}
+
+func TestDataCSVAndPrometheus(t *testing.T) {
+	cfg := testConfig(t, "-device", simDevice, "-location", "office")
+	st := newState(cfg)
+	h := newServer(context.Background(), cfg, st).handler()
+	st.Update(testReading(t, testLine))
+
+	w := get(t, h, "/data", "text/csv")
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type %v, want text/csv", ct)
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || !slices.Equal(rows[0], csvColumns) {
+		t.Fatalf("CSV %q, want the header and a row", rows)
+	}
+	row := map[string]string{}
+	for i, c := range rows[0] {
+		row[c] = rows[1][i]
+	}
+	for c, want := range map[string]string{"co2": "650", "humidity": "58.86", "temperature": "22.5", "seq": "1", "co2_compensated": "", "stale": "false"} {
+		if row[c] != want {
+			t.Errorf("CSV %v = %q, want %q", c, row[c], want)
+		}
+	}
+
+	w = get(t, h, "/data", "text/plain")
+	if ct := w.Header().Get("Content-Type"); ct != contentTypePrometheus {
+		t.Errorf("Content-Type %v, want %v", ct, contentTypePrometheus)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "\nudco2s_co2_ppm{location=\"office\"} 650\n") {
+		t.Errorf("Prometheus format %v, want the CO2 gauge", body)
+	}
+}
+
+func TestNegotiateSpecificity(t *testing.T) {
+	offers := []string{"application/json", "application/xml"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"application/json;q=0, */*", "application/xml"},
+		{"*/*;q=0.1, application/xml;q=0.5", "application/xml"},
+		{"application/*;q=0.2, application/json", "application/json"},
+		{"application/*;q=0, application/xml", "application/xml"},
+		{"text/*, application/json;q=0", ""},
+		{"*/*, application/json;q=0, application/xml;q=0", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/data", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := negotiate(r, offers...); got != tt.want {
+			t.Errorf("Accept %q: %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
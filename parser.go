@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+// readingPattern matches a reading streamed by the device
+var readingPattern = regexp.MustCompile(`CO2=(?P<co2>\d+),HUM=(?P<humidity>[0-9\.]+),TMP=(?P<temperature>[0-9\.-]+)`)
+
+// parserSamples is the number of recent lines kept for /debug/parser
+const parserSamples = 10
+
+// parsedLine is a line read from the device along with how it was parsed
+type parsedLine struct {
+	Time    ISO8601Time `json:"time"`
+	Line    string      `json:"line"` // sanitized
+	Matched bool        `json:"matched"`
+	Error   string      `json:"error,omitempty"` // the reading matched but failed to parse
+}
+
+// parsedLines keeps the most recent lines, matched or not
+type parsedLines struct {
+	lines *ring[parsedLine]
+}
+
+func newParsedLines(size int) *parsedLines {
+	return &parsedLines{lines: newRing[parsedLine](size)}
+}
+
+// Add keeps line with its result, dropping the oldest one if the buffer is full
+func (p *parsedLines) Add(t time.Time, line string, matched bool, err error) {
+	l := parsedLine{Time: ISO8601Time(t), Line: sanitize(line), Matched: matched}
+	if err != nil {
+		l.Error = err.Error()
+	}
+	p.lines.Add(l)
+}
+
+// Lines returns the kept lines, oldest first
+func (p *parsedLines) Lines() []parsedLine {
+	return p.lines.Values()
+}
@@ -0,0 +1,39 @@
+package main
+
+// policies for a high ratio of lines failing to parse
+const (
+	parseErrorsIgnore = "ignore"
+	parseErrorsWarn   = "warn"
+	parseErrorsExit   = "exit"
+)
+
+// parseStats keeps the parse results of the most recent lines
+type parseStats struct {
+	results *ring[bool] // success flags
+	window  int
+}
+
+func newParseStats(window int) *parseStats {
+	return &parseStats{results: newRing[bool](window), window: window}
+}
+
+// Record adds the result of parsing a line
+func (p *parseStats) Record(ok bool) {
+	p.results.Add(ok)
+}
+
+// Ratio returns the ratio of successfully parsed lines in the window and
+// whether the window is filled. It returns -1 when no line was recorded yet.
+func (p *parseStats) Ratio() (float64, bool) {
+	results := p.results.Values()
+	if len(results) == 0 {
+		return -1, false
+	}
+	ok := 0
+	for _, r := range results {
+		if r {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(results)), len(results) == p.window
+}
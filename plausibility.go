@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// default plausible ranges of the values served, given as "min,max"
+const (
+	defaultCO2Range         = "1,10000"
+	defaultTemperatureRange = "-20,60"
+	defaultHumidityRange    = "0,100"
+)
+
+// valueRange is an inclusive range of plausible values
+type valueRange struct {
+	min, max float64
+}
+
+func (r valueRange) contains(v float64) bool {
+	return v >= r.min && v <= r.max
+}
+
+// parseRange parses the comma separated minimum and maximum of a range
+func parseRange(name, s string) (valueRange, error) {
+	lo, hi, ok := strings.Cut(s, ",")
+	if !ok {
+		return valueRange{}, fmt.Errorf("invalid %v range %q: min,max is required", name, s)
+	}
+	min, err := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+	if err != nil {
+		return valueRange{}, fmt.Errorf("invalid %v range %q: %w", name, s, err)
+	}
+	max, err := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+	if err != nil {
+		return valueRange{}, fmt.Errorf("invalid %v range %q: %w", name, s, err)
+	}
+	if min > max {
+		return valueRange{}, fmt.Errorf("invalid %v range %q: min must not exceed max", name, s)
+	}
+	return valueRange{min, max}, nil
+}
+
+// plausibility rejects readings with values out of their ranges or changing
+// more since the previous accepted reading than a sensor can. A spliced line
+// or a sentinel value reported while the device warms up fails these checks.
+type plausibility struct {
+	co2, temperature, humidity    valueRange
+	temperatureStep, humidityStep float64 // 0 if unchecked
+	prev                          *Data
+}
+
+func newPlausibility(cfg *config) *plausibility {
+	return &plausibility{
+		co2:             cfg.plausibleCO2,
+		temperature:     cfg.plausibleTemperature,
+		humidity:        cfg.plausibleHumidity,
+		temperatureStep: cfg.maxTemperatureStep,
+		humidityStep:    cfg.maxHumidityStep,
+	}
+}
+
+// check returns why d is implausible, or nil after taking it as the previous reading.
+// co2 is the CO2 reported by the device, before the offset.
+func (p *plausibility) check(co2 int64, d *Data) error {
+	if !p.co2.contains(float64(co2)) {
+		return fmt.Errorf("co2 %v out of range", co2)
+	}
+	if d.Temperature != nil {
+		t := *d.Temperature
+		if !p.temperature.contains(t) {
+			return fmt.Errorf("temperature %.1f out of range", t)
+		}
+		if p.temperatureStep > 0 && p.prev != nil && p.prev.Temperature != nil && math.Abs(t-*p.prev.Temperature) > p.temperatureStep {
+			return fmt.Errorf("temperature jumped from %.1f to %.1f", *p.prev.Temperature, t)
+		}
+	}
+	if d.Humidity != nil {
+		h := *d.Humidity
+		if !p.humidity.contains(h) {
+			return fmt.Errorf("humidity %.1f out of range", h)
+		}
+		if p.humidityStep > 0 && p.prev != nil && p.prev.Humidity != nil && math.Abs(h-*p.prev.Humidity) > p.humidityStep {
+			return fmt.Errorf("humidity jumped from %.1f to %.1f", *p.prev.Humidity, h)
+		}
+	}
+	p.prev = d
+	return nil
+}
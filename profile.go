@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// startProfiles starts the CPU profile given by -profile-cpu, stopping it after
+// -profile-cpu-duration. The returned function stops it early if it is still running
+// and writes the heap profile given by -profile-mem; call it on exit.
+func startProfiles(cfg *config) (func(), error) {
+	stopCPU := func() {}
+	if cfg.profileCPU != "" {
+		f, err := os.Create(cfg.profileCPU)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		var once sync.Once
+		stopCPU = func() {
+			once.Do(func() {
+				pprof.StopCPUProfile()
+				if err := f.Close(); err != nil {
+					log.Printf("Warning: failed to write CPU profile: %v\n", err)
+					return
+				}
+				log.Printf("Wrote CPU profile to %v\n", cfg.profileCPU)
+			})
+		}
+		if cfg.profileCPUDuration > 0 {
+			t := time.AfterFunc(cfg.profileCPUDuration, stopCPU)
+			prev := stopCPU
+			stopCPU = func() {
+				t.Stop()
+				prev()
+			}
+		}
+	}
+
+	return func() {
+		stopCPU()
+		if cfg.profileMem != "" {
+			if err := writeHeapProfile(cfg.profileMem); err != nil {
+				log.Printf("Warning: failed to write heap profile: %v\n", err)
+				return
+			}
+			log.Printf("Wrote heap profile to %v\n", cfg.profileMem)
+		}
+	}, nil
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
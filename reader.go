@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"go.bug.st/serial"
+)
+
+// port is the subset of serial.Port used by the reader
+type port interface {
+	io.ReadWriteCloser
+	SetReadTimeout(t time.Duration) error
+}
+
+// closers is a port closing additional resources along with it
+type closers struct {
+	port
+	cs []io.Closer
+}
+
+func (c *closers) Close() error {
+	var errs []error
+	for _, c := range c.cs {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// openDevice opens the port read by readDevice, replaced by a fake in tests
+var openDevice = openPort
+
+// openPort opens the device given by cfg. The serial parameters are nil
+// unless it is a serial port.
+func openPort(cfg *config) (port, *serialParams, error) {
+	if cfg.replay {
+		f, err := os.Open(cfg.device)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Replaying %v\n", cfg.device)
+		p := newSimPort(cfg.simInterval, replayLines(f))
+		return &closers{p, []io.Closer{p, f}}, nil, nil
+	}
+	if cfg.device == simDevice {
+		log.Printf("Using simulated device (seed: %v)\n", cfg.simSeed)
+		return newSimPort(cfg.simInterval, randomWalk(cfg.simSeed)), nil, nil
+	}
+	path, err := resolveDevice(cfg.device)
+	if err != nil {
+		return nil, nil, err
+	}
+	mode := serialMode(defaultBaudRate)
+	p, err := serial.Open(path, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.autoBaud {
+		if mode.BaudRate, err = probeBaudRate(p); err != nil {
+			p.Close()
+			return nil, nil, err
+		}
+	}
+	return p, newSerialParams(mode), nil
+}
+
+// prepareSettle is the pause before each command for devices needing time to settle
+const prepareSettle = 10 * time.Millisecond
+
+// prepareDevice stops the device, asks its identification and starts streaming.
+// Each command must be answered within timeout unless it is 0; the port is
+// closed otherwise. It returns the identification, or "" if the device did not report one.
+func prepareDevice(ctx context.Context, p port, s *bufio.Scanner, timeout time.Duration) (string, error) {
+	log.Println("Prepare device...:")
+	id := ""
+	for _, c := range []string{"STP", "ID?", "STA"} {
+		log.Printf(" %v", c)
+		time.Sleep(prepareSettle)
+		if _, err := p.Write([]byte(c + "\r\n")); err != nil {
+			return "", err
+		}
+		var timedOut atomic.Bool
+		stop := func() bool { return true }
+		if timeout > 0 {
+			stop = time.AfterFunc(timeout, func() {
+				timedOut.Store(true)
+				p.Close() // unblock the scanner
+			}).Stop
+		}
+		ok := false
+		for !ok && s.Scan() {
+			select {
+			case <-ctx.Done():
+				stop()
+				return "", errors.New("context canceled")
+			default:
+				// do nothing
+			}
+			t := trimLine(s.Text())
+			if isResponse(t, `OK`) {
+				ok = true
+				if c == "ID?" && isResponse(t, `OK ID=`) {
+					id = sanitize(strings.TrimSpace(t[len(`OK ID=`):]))
+				}
+			} else if isResponse(t, `NG`) {
+				stop()
+				return "", fmt.Errorf(" command `%v` failed", c)
+			}
+		}
+		if !stop() || !ok {
+			if timedOut.Load() {
+				return "", fmt.Errorf(" command `%v` failed: no response within %v", c, timeout)
+			}
+			if err := s.Err(); err != nil {
+				return "", fmt.Errorf(" command `%v` failed: %w", c, err)
+			}
+			return "", fmt.Errorf(" command `%v` failed: no response", c)
+		}
+	}
+	log.Println(" OK.")
+	if id != "" {
+		log.Printf("Device ID: %v\n", id)
+	}
+	return id, nil
+}
+
+// timedReader records when data was last read from r.
+// Lines are timestamped with the arrival of their last chunk rather than
+// with the time they are taken out of the scanner.
+//
+// A read timeout of the serial port, which reads nothing without an error,
+// is retried rather than passed on, as bufio.Scanner fails after a hundred
+// of them in a row. It reports io.EOF instead once ctx is done.
+type timedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	last  time.Time
+	bytes *atomic.Uint64 // incremented by the bytes read
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.r.Read(p)
+		if n > 0 {
+			t.last = time.Now()
+			t.bytes.Add(uint64(n))
+		}
+		if n > 0 || err != nil || len(p) == 0 {
+			return n, err
+		}
+		if t.ctx.Err() != nil {
+			return 0, io.EOF
+		}
+	}
+}
+
+// policies for a device streaming no readings after STA
+const (
+	noStreamRetry = "retry"
+	noStreamExit  = "exit"
+)
+
+// line endings of the device
+const (
+	lineEndingCRLF = "crlf"
+	lineEndingLF   = "lf"
+	lineEndingCR   = "cr"
+)
+
+// splitLines returns the split function of the scanner for the line ending
+func splitLines(ending string) bufio.SplitFunc {
+	if ending != lineEndingCR {
+		return bufio.ScanLines // splits on LF, dropping a CR before it
+	}
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.IndexByte(data, '\r'); i >= 0 {
+			return i + 1, bytes.TrimPrefix(data[:i], []byte("\n")), nil
+		}
+		if atEOF {
+			return len(data), bytes.TrimPrefix(data, []byte("\n")), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// trimLine removes the whitespace and control characters around a line read
+// from the device, e.g. a stray CR or a leading space added by a USB bridge
+func trimLine(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+// isResponse reports whether the trimmed line t starts with the response prefix, ignoring the case
+func isResponse(t, prefix string) bool {
+	return len(t) >= len(prefix) && strings.EqualFold(t[:len(prefix)], prefix)
+}
+
+// sanitize escapes the bytes of a line read from the device that are not printable ASCII,
+// e.g. garbage read at a wrong baud rate, so that logging it cannot mangle the terminal
+func sanitize(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x20 && c < 0x7f {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// drainStop waits up to timeout for the device to acknowledge STP,
+// discarding the readings still in flight. Closing the port afterwards
+// unblocks the scanner if the device does not answer in time.
+func drainStop(s *bufio.Scanner, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for s.Scan() {
+			if isResponse(trimLine(s.Text()), `OK STP`) {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Warning: no response to STP within %v\n", timeout)
+	}
+}
+
+var (
+	// errNotResponding is returned when the watchdog gave up on the device
+	errNotResponding = errors.New("device is not responding")
+	// errOpen is returned when the device could not be opened
+	errOpen = errors.New("failed to open port")
+	// errIO is returned when reading the device failed, e.g. it was unplugged
+	errIO = errors.New("failed to read device")
+	// errNoStream is returned when the device accepted STA but streamed no reading
+	// with the exit policy, which is retried like errNotResponding otherwise
+	errNoStream = errors.New("device streams no readings")
+	// errParseErrors is returned when too many lines failed to parse with the exit policy
+	errParseErrors = errors.New("too many parse errors")
+)
+
+// runReader reads the device into st until ctx is done, reconnecting when the device
+// hangs or fails to read. Failing to reopen or prepare it while reconnecting is
+// retried too, e.g. until it is plugged in again or recovers from hanging.
+func runReader(ctx context.Context, cfg *config, st *state) error {
+	if len(cfg.devices) > 1 {
+		return runAggregate(ctx, cfg, st)
+	}
+
+	var rec *recorder
+	if cfg.record != "" {
+		var err error
+		if rec, err = newRecorder(cfg.record, cfg.recordMaxSize); err != nil {
+			return err
+		}
+		defer rec.Close()
+	}
+
+	reconnecting := false
+	for {
+		err := readDevice(ctx, cfg, st, rec)
+		retry := errors.Is(err, errNotResponding) || errors.Is(err, errIO) ||
+			reconnecting && (errors.Is(err, errOpen) || errors.Is(err, errPrepare)) ||
+			errors.Is(err, errNoStream) && cfg.onNoStream == noStreamRetry
+		if !retry {
+			if err != nil {
+				st.SetStatus(statusUnavailable)
+			}
+			return err
+		}
+		if !errors.Is(err, errNotResponding) && !errors.Is(err, errNoStream) {
+			log.Printf("Warning: %v\n", err)
+		}
+		reconnecting = true
+		if !st.ctl.Paused() {
+			// a paused reader stays paused, the reopened device is stopped again
+			st.SetStatus(statusReconnecting)
+		}
+		log.Printf("Reconnecting in %v...\n", cfg.reconnectDelay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.reconnectDelay):
+		}
+	}
+}
+
+// readDevice opens the device and stores its readings into st until ctx is done
+func readDevice(ctx context.Context, cfg *config, st *state, rec *recorder) error {
+	port, params, err := openDevice(cfg)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errOpen, err)
+	}
+	st.SetSerial(params)
+	port.SetReadTimeout(readTimeout)
+	var r io.Reader = port
+	if rec != nil {
+		r = io.TeeReader(port, rec)
+	}
+	tr := &timedReader{ctx: ctx, r: r, bytes: &st.counters.bytesRead}
+	s := bufio.NewScanner(tr)
+	s.Split(splitLines(cfg.lineEnding))
+
+	defer func() {
+		port.Write([]byte("STP\r\n"))
+		drainStop(s, cfg.stopDrain)
+		port.Close()
+	}()
+
+	id, err := prepareDevice(ctx, port, s, cfg.prepareTimeout)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil // shut down while preparing
+		}
+		return fmt.Errorf("%w: %w", errPrepare, err)
+	}
+	st.SetDeviceID(id)
+	if err := st.ctl.attach(port); err != nil {
+		return err
+	}
+	defer st.ctl.detach()
+
+	// nothing is streamed while paused, so unblock the scanner on shutdown
+	defer context.AfterFunc(ctx, func() {
+		if st.ctl.Paused() {
+			port.Close()
+		}
+	})()
+
+	var wd *watchdog
+	if cfg.watchdog > 0 {
+		wd = newWatchdog(cfg.watchdog)
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go wd.run(wctx, port, st.ctl.Paused)
+	}
+
+	// a device in another mode accepts STA but streams nothing, which would
+	// otherwise look like waiting for the first reading forever
+	var noStream atomic.Bool
+	var streamTimer *time.Timer
+	if cfg.streamTimeout > 0 {
+		streamTimer = time.AfterFunc(cfg.streamTimeout, func() {
+			if st.ctl.Paused() {
+				return // no reading is expected
+			}
+			log.Printf("Warning: the device accepted STA but sent no reading within %v. "+
+				"It may be in another mode, or -line-ending or the baud rate may not match it.\n", cfg.streamTimeout)
+			noStream.Store(true)
+			port.Close() // unblock the scanner
+		})
+		defer streamTimer.Stop()
+	}
+
+	var plausible *plausibility
+	if cfg.plausibility {
+		plausible = newPlausibility(cfg)
+	}
+
+	var lastWarn time.Time
+	record := func(ok bool) error {
+		st.parse.Record(ok)
+		ratio, full := st.parse.Ratio()
+		if !full || 1-ratio <= cfg.parseErrorThreshold {
+			return nil
+		}
+		switch cfg.onParseErrors {
+		case parseErrorsWarn:
+			if time.Since(lastWarn) >= time.Minute {
+				log.Printf("Warning: only %.0f%% of recent lines were parsed, check the device and the baud rate\n", ratio*100)
+				lastWarn = time.Now()
+			}
+		case parseErrorsExit:
+			return fmt.Errorf("%w: %.0f%% of recent lines were parsed", errParseErrors, ratio*100)
+		}
+		return nil
+	}
+
+	// reader (main)
+	// the scanner is bound to this port only; a reconnect goes through
+	// readDevice again and gets a fresh one
+scan:
+	for s.Scan() {
+		select {
+		case <-ctx.Done():
+			break scan
+		default:
+			// do nothing
+		}
+		now := tr.last
+		text := trimLine(s.Text())
+		st.counters.linesRead.Add(1)
+		if text == "" {
+			continue
+		}
+		m := readingPattern.FindAllStringSubmatch(text, -1)
+		if len(m) > 0 {
+			st.counters.linesMatched.Add(1)
+			d, err := parseData(m[0], now, cfg.humidityBasis)
+			st.parsed.Add(now, text, true, err)
+			if err := record(err == nil); err != nil {
+				return err
+			}
+			if err != nil {
+				log.Printf("Skip reading: %v\n", err)
+				continue
+			}
+			raw := d.CO2
+			if plausible != nil {
+				if err := plausible.check(raw, d); err != nil {
+					log.Printf("Skip implausible reading: %v: %v\n", err, sanitize(text))
+					continue
+				}
+			}
+			d.CO2 = max(d.CO2+cfg.co2Offset, 0)
+			if cfg.includeCorrections {
+				d.Corrections = &Corrections{
+					RawCO2:            raw,
+					CO2Offset:         cfg.co2Offset,
+					CO2Clamped:        raw+cfg.co2Offset < 0,
+					RawTemperature:    d.rawTemperature,
+					TemperatureOffset: -temperatureOffset,
+					RawHumidity:       d.rawHumidity,
+					HumidityBasis:     cfg.humidityBasis,
+					HumidityCorrected: d.Humidity != nil && cfg.humidityBasis != humidityBasisNone,
+				}
+				if cfg.pressure > 0 {
+					d.Corrections.PressureHPa = &cfg.pressure
+				}
+			}
+			if cfg.pressure > 0 {
+				c := compensatePressure(d.CO2, cfg.pressure)
+				d.CO2Compensated = &c
+			}
+			if cfg.comfort {
+				if i, l, ok := comfort(d, cfg.comfortThresholdList); ok {
+					d.ComfortIndex, d.ComfortLevel = &i, l
+				}
+			}
+			d.Location = cfg.location
+			if streamTimer != nil {
+				streamTimer.Stop()
+				streamTimer = nil
+			}
+			st.Update(d)
+			if wd != nil {
+				wd.Alive()
+			}
+			if cfg.maxReadings > 0 && st.Seq() >= cfg.maxReadings {
+				log.Printf("Read %v readings, stopping.\n", cfg.maxReadings)
+				break scan
+			}
+		} else if isResponse(text, `OK STP`) {
+			if st.ctl.Paused() {
+				continue
+			}
+			break // exit 0
+		} else if isResponse(text, `OK`) {
+			// the answer to STA sent by /resume or to a probe of the watchdog
+			if wd != nil {
+				wd.Alive()
+			}
+		} else {
+			st.counters.linesUnmatched.Add(1)
+			log.Printf("Read unmatched string: %v\n", sanitize(text))
+			st.parsed.Add(now, text, false, nil)
+			st.unmatched.Add(now, text)
+			if err := record(false); err != nil {
+				return err
+			}
+		}
+	}
+	if noStream.Load() {
+		return errNoStream
+	}
+	if wd != nil && wd.Fired() {
+		return errNotResponding
+	}
+	if err := s.Err(); err != nil && ctx.Err() == nil {
+		st.counters.scannerErrors.Add(1)
+		return fmt.Errorf("%w: %w", errIO, err)
+	}
+
+	log.Println("Reader stopped.")
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fakePort is a port answering the commands like the device. It reads the
+// lines given to send, and times out every millisecond while there is none.
+type fakePort struct {
+	in       chan []byte
+	started  chan struct{} // closed on the first STA
+	closed   chan struct{}
+	once     sync.Once
+	startOne sync.Once
+	timeouts atomic.Int64 // reads that timed out
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{
+		in:      make(chan []byte, 64),
+		started: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// send queues line to be read, followed by CRLF
+func (p *fakePort) send(line string) {
+	p.in <- []byte(line + "\r\n")
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, errors.New("port closed")
+	case c := <-p.in:
+		return copy(b, c), nil
+	case <-time.After(time.Millisecond):
+		// like a serial port, a timeout reads nothing without an error
+		p.timeouts.Add(1)
+		return 0, nil
+	}
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, errors.New("port closed")
+	default:
+	}
+	for _, c := range strings.Fields(string(b)) {
+		switch c {
+		case "STA":
+			p.send("OK STA")
+			p.startOne.Do(func() { close(p.started) })
+		case "STP":
+			p.send("OK STP")
+		case "ID?":
+			p.send("OK ID=FAKE")
+		default:
+			p.send("NG")
+		}
+	}
+	return len(b), nil
+}
+
+func (p *fakePort) SetReadTimeout(t time.Duration) error {
+	return nil
+}
+
+func (p *fakePort) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// useFakePorts makes the reader open ps in turn, and fail to open any more.
+// It returns the number of ports opened so far.
+func useFakePorts(t *testing.T, ps ...*fakePort) func() int {
+	t.Helper()
+	var opened atomic.Int64
+	open := openDevice
+	openDevice = func(*config) (port, *serialParams, error) {
+		n := int(opened.Add(1))
+		if n > len(ps) {
+			return nil, nil, errors.New("no more fake ports")
+		}
+		return ps[n-1], nil, nil
+	}
+	t.Cleanup(func() { openDevice = open })
+	return func() int { return int(opened.Load()) }
+}
+
+// waitFor fails t unless cond holds within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startReader runs the reader of st in the background, returning the function
+// shutting it down and returning its error
+func startReader(t *testing.T, cfg *config, st *state) func() error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runReader(ctx, cfg, st)
+	}()
+	t.Cleanup(cancel)
+	return func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("reader did not stop")
+			return nil
+		}
+	}
+}
+
+const testLine = "CO2=650,HUM=45.0,TMP=27.0"
+
+func TestReaderReopensPortClosedMidScan(t *testing.T) {
+	p1, p2 := newFakePort(), newFakePort()
+	opened := useFakePorts(t, p1, p2)
+	cfg := testConfig(t, "-device", "/dev/ttyFAKE", "-reconnect-delay", "10ms")
+	st := newState(cfg)
+	stop := startReader(t, cfg, st)
+
+	<-p1.started
+	// short and empty lines must not trip the reader up
+	p1.send("")
+	p1.send("O")
+	p1.send(testLine)
+	waitFor(t, "the first reading", func() bool { return st.Seq() == 1 })
+
+	// closed underneath the scanner blocked in a read
+	p1.Close()
+	select {
+	case <-p2.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("port was not reopened")
+	}
+	// a fresh scanner reads the new port
+	p2.send(testLine)
+	waitFor(t, "the reading after the reconnect", func() bool { return st.Seq() == 2 })
+	if status := st.Status(); status != statusRunning {
+		t.Errorf("status = %v, want %v", status, statusRunning)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("reader failed: %v", err)
+	}
+	if n := opened(); n != 2 {
+		t.Errorf("opened %v ports, want 2", n)
+	}
+	if n := st.counters.linesUnmatched.Load(); n != 1 {
+		t.Errorf("%v unmatched lines, want 1", n)
+	}
+}
+
+func TestSplitLinesCR(t *testing.T) {
+	in := "OK STA\r" + testLine + "\r\r\n" + testLine + "\rCO2=6"
+	want := []string{"OK STA", testLine, "", testLine, "CO2=6"}
+	// one byte at a time, as a line may arrive in several reads
+	s := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(in)))
+	s.Split(splitLines(lineEndingCR))
+	var got []string
+	for s.Scan() {
+		got = append(got, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("lines %q, want %q", got, want)
+	}
+}
+
+func TestReaderKeepsPortOverReadTimeouts(t *testing.T) {
+	p := newFakePort()
+	opened := useFakePorts(t, p)
+	cfg := testConfig(t, "-device", "/dev/ttyFAKE", "-reconnect-delay", "10ms")
+	st := newState(cfg)
+	stop := startReader(t, cfg, st)
+
+	<-p.started
+	p.send(testLine)
+	waitFor(t, "the first reading", func() bool { return st.Seq() == 1 })
+	// more timeouts in a row than bufio.Scanner takes before failing
+	n := p.timeouts.Load()
+	waitFor(t, "read timeouts", func() bool { return p.timeouts.Load() >= n+200 })
+	p.send(testLine)
+	waitFor(t, "the reading after the timeouts", func() bool { return st.Seq() == 2 })
+
+	if err := stop(); err != nil {
+		t.Errorf("reader failed: %v", err)
+	}
+	if n := opened(); n != 1 {
+		t.Errorf("opened %v ports, want 1", n)
+	}
+	if n := st.counters.scannerErrors.Load(); n != 0 {
+		t.Errorf("%v scanner errors, want 0", n)
+	}
+	if st.Latest().reconnected {
+		t.Error("reading marked as reconnected")
+	}
+}
+
+func TestTrimLineAndIsResponse(t *testing.T) {
+	tests := []struct {
+		line   string
+		prefix string
+		want   bool
+	}{
+		{" OK\r", "OK", true},
+		{"OK \r\n", "OK", true},
+		{"\x00 ok sta\r", "OK STA", true},
+		{"Ok Stp", "OK STP", true},
+		{" NG\r", "OK", false},
+		{"O", "OK", false},
+		{"", "OK", false},
+	}
+	for _, tt := range tests {
+		if got := isResponse(trimLine(tt.line), tt.prefix); got != tt.want {
+			t.Errorf("isResponse(trimLine(%q), %q) = %v, want %v", tt.line, tt.prefix, got, tt.want)
+		}
+	}
+	if got := trimLine(" OK ID=UD-CO2S \r\n"); got != "OK ID=UD-CO2S" {
+		t.Errorf("trimLine = %q", got)
+	}
+}
+
+func TestPrepareDeviceLooseResponses(t *testing.T) {
+	s := bufio.NewScanner(strings.NewReader(" OK STP\r\n\r\nok id=UD-CO2S \r\n\x00Ok Sta\r\n"))
+	id, err := prepareDevice(context.Background(), newFakePort(), s, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "UD-CO2S" {
+		t.Errorf("id = %q, want UD-CO2S", id)
+	}
+}
+
+func TestReaderStaysPausedAcrossReconnect(t *testing.T) {
+	p1, p2 := newFakePort(), newFakePort()
+	useFakePorts(t, p1, p2)
+	cfg := testConfig(t, "-device", "/dev/ttyFAKE", "-reconnect-delay", "10ms")
+	st := newState(cfg)
+	stop := startReader(t, cfg, st)
+
+	<-p1.started
+	p1.send(testLine)
+	waitFor(t, "the first reading", func() bool { return st.Seq() == 1 })
+	if err := st.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	p1.Close()
+	<-p2.started
+	// a reading still in flight before the reopened device is stopped again
+	p2.send(testLine)
+	waitFor(t, "the reading to be read", func() bool { return st.counters.linesMatched.Load() == 2 })
+	if status, seq := st.Status(), st.Seq(); status != statusPaused || seq != 1 || !st.ctl.Paused() {
+		t.Errorf("after reconnect: status %v, seq %v, paused %v; want paused at seq 1", status, seq, st.ctl.Paused())
+	}
+
+	waitFor(t, "the device to be attached", func() bool { return st.Resume() == nil })
+	p2.send(testLine)
+	waitFor(t, "the reading after resuming", func() bool { return st.Seq() == 2 })
+	if status := st.Status(); status != statusRunning {
+		t.Errorf("status %v after resuming, want %v", status, statusRunning)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("reader failed: %v", err)
+	}
+}
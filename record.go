@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// recorder writes the raw lines read from the device to a file, each prefixed
+// with the time it was read and a tab. When the file exceeds maxSize, it is
+// renamed with a ".1" suffix, replacing the previous one, and a new file is started.
+type recorder struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+	buf     []byte // incomplete line
+}
+
+func newRecorder(path string, maxSize int64) (*recorder, error) {
+	r := &recorder{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open record file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open record file: %w", err)
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *recorder) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Write records the complete lines in p. It never fails so that a recording
+// problem does not stop the reader; errors are logged instead.
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+	// lines end with CR, LF or both depending on -line-ending
+	for {
+		i := bytes.IndexAny(r.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			r.record(r.buf[:i])
+		}
+		r.buf = r.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (r *recorder) record(line []byte) {
+	if r.f == nil {
+		return // failed to rotate
+	}
+	n, err := fmt.Fprintf(r.f, "%v\t%s\n", time.Now().Format(time.RFC3339Nano), line)
+	r.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to record line: %v\n", err)
+		return
+	}
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Printf("Failed to rotate record file: %v\n", err)
+			r.f = nil
+		}
+	}
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
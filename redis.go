@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisTimeout bounds connecting to Redis and each command
+const redisTimeout = 5 * time.Second
+
+// redisConn is a minimal Redis client speaking RESP over a single connection,
+// which is enough for the one goroutine writing to it. It redials on the next
+// command after a connection failure, authenticating with password if set.
+type redisConn struct {
+	addr     string
+	password string
+	conn     net.Conn
+	r        *bufio.Reader
+}
+
+// errRedis is a reply of Redis telling that the command failed, unlike a connection failure
+type errRedis string
+
+func (e errRedis) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends the command args and reads its reply, discarding it unless it is an error
+func (c *redisConn) do(args ...string) error {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+		if err != nil {
+			return err
+		}
+		c.conn, c.r = conn, bufio.NewReader(conn)
+		if c.password != "" {
+			if err := c.roundTrip([]string{"AUTH", c.password}); err != nil {
+				c.conn.Close()
+				c.conn = nil
+				return err
+			}
+		}
+	}
+	if err := c.roundTrip(args); err != nil {
+		if !errors.As(err, new(errRedis)) {
+			c.conn.Close()
+			c.conn = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *redisConn) roundTrip(args []string) error {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	b := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, a := range args {
+		b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) < 3 {
+		return errors.New("redis: invalid reply")
+	}
+	switch t, v := line[0], line[1:len(line)-2]; t {
+	case '+', ':':
+		return nil
+	case '-':
+		return errRedis(v)
+	case '$':
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("redis: invalid reply: %w", err)
+		}
+		if n >= 0 {
+			_, err = io.CopyN(io.Discard, c.r, int64(n)+2)
+		}
+		return err
+	default:
+		return fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (c *redisConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// runRedis sets each reading as JSON to -redis-key, expiring after -redis-ttl,
+// and publishes it to -redis-channel until ctx is done. A reading is skipped
+// while Redis is unreachable, and the connection is retried with the next one.
+// Writes are at least -export-min-interval apart, keeping the latest reading.
+func runRedis(ctx context.Context, cfg *config, st *state, enc *encoder) error {
+	c, unsubscribe := st.subs.SubscribeSink("redis", cfg.buffer)
+	defer unsubscribe()
+
+	rc := &redisConn{addr: cfg.redisAddr, password: cfg.redisPassword}
+	defer rc.Close()
+
+	down := false
+	write := func(d *Data) error {
+		b, err := enc.JSON(d)
+		if err != nil {
+			return err
+		}
+		err = nil
+		if cfg.redisKey != "" {
+			args := []string{"SET", cfg.redisKey, string(b)}
+			if cfg.redisTTL > 0 {
+				args = append(args, "PX", strconv.FormatInt(cfg.redisTTL.Milliseconds(), 10))
+			}
+			err = rc.do(args...)
+		}
+		if err == nil && cfg.redisChannel != "" {
+			err = rc.do("PUBLISH", cfg.redisChannel, string(b))
+		}
+		if err != nil {
+			if !down {
+				log.Printf("Warning: failed to write to Redis, skipping readings until it is back: %v\n", err)
+				down = true
+			}
+			return nil
+		}
+		if down {
+			log.Println("Writing to Redis again.")
+			down = false
+		}
+		return nil
+	}
+	// with -export-min-interval, the readings arriving within the interval
+	// after a write are coalesced into the latest of them, written once it ends
+	var (
+		last    time.Time
+		pending *Data
+		due     <-chan time.Time
+	)
+	// drain writes out the queued readings, coalesced with -export-min-interval
+	drain := func() (int, error) {
+		n := 0
+		for {
+			select {
+			case d := <-c:
+				if cfg.exportMinInterval > 0 {
+					pending = d
+					continue
+				}
+				if err := write(d); err != nil {
+					return n, err
+				}
+				n++
+			default:
+				if pending == nil {
+					return n, nil
+				}
+				d := pending
+				pending, due = nil, nil
+				last = time.Now()
+				return n + 1, write(d)
+			}
+		}
+	}
+	flushes, unregister := st.flushers.Register("redis")
+	defer unregister()
+	for {
+		select {
+		case <-ctx.Done():
+			// the reader has stopped, write out what is left
+			_, err := drain()
+			return err
+		case reply := <-flushes:
+			n, err := drain()
+			reply <- n
+			if err != nil {
+				return err
+			}
+		case d := <-c:
+			if wait := cfg.exportMinInterval - time.Since(last); wait > 0 {
+				if pending == nil {
+					due = time.After(wait)
+				}
+				pending = d
+				continue
+			}
+			last = time.Now()
+			if err := write(d); err != nil {
+				return err
+			}
+		case <-due:
+			d := pending
+			pending, due = nil, nil
+			last = time.Now()
+			if err := write(d); err != nil {
+				return err
+			}
+		}
+	}
+}
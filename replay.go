@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// replayLines returns the lines read from r, for replaying a capture of the device output.
+// The timestamps added by -record are removed, and so are the command responses
+// since the port answers the commands by itself.
+func replayLines(r io.Reader) func() (string, bool) {
+	s := bufio.NewScanner(r)
+	return func() (string, bool) {
+		for s.Scan() {
+			line := s.Text()
+			if ts, rest, ok := strings.Cut(line, "\t"); ok {
+				if _, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+					line = rest
+				}
+			}
+			if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NG") {
+				continue
+			}
+			return line, true
+		}
+		if err := s.Err(); err != nil {
+			log.Printf("Failed to read replay file: %v\n", err)
+		}
+		log.Println("Replay finished.")
+		return "", false
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// ring keeps the most recent values, dropping the oldest one once size of
+// them are kept. It is safe for concurrent use.
+type ring[T any] struct {
+	mu     sync.Mutex
+	values []T
+	next   int
+	full   bool
+}
+
+func newRing[T any](size int) *ring[T] {
+	return &ring[T]{values: make([]T, size)}
+}
+
+// Add keeps v; a ring of size 0 keeps nothing
+func (r *ring[T]) Add(v T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.values) == 0 {
+		return
+	}
+	r.values[r.next] = v
+	r.next++
+	if r.next == len(r.values) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Values returns a copy of the kept values, oldest first
+func (r *ring[T]) Values() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]T{}, r.values[:r.next]...)
+	}
+	return append(append([]T{}, r.values[r.next:]...), r.values[:r.next]...)
+}
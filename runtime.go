@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// rough sizes of the buffered items for -max-memory, erring on the high side
+const (
+	dataSize          = 1 << 10                // a reading with its fields
+	unmatchedLineSize = bufio.MaxScanTokenSize // the longest line the scanner reads
+	// the share of -max-memory a single buffer may take
+	bufferShare = 16
+)
+
+// tuneRuntime applies -gomaxprocs and -max-memory
+func tuneRuntime(cfg *config) {
+	setGOMAXPROCS(cfg.gomaxprocs)
+	if cfg.maxMemory > 0 {
+		limitMemory(cfg)
+	}
+}
+
+// setGOMAXPROCS sets GOMAXPROCS to n. When it is 0, GOMAXPROCS is lowered to
+// the CPU quota of the container, if any, so that the process does not run
+// more threads than it gets CPU time for; the GOMAXPROCS environment
+// variable still takes precedence then.
+func setGOMAXPROCS(n int) {
+	if n > 0 {
+		runtime.GOMAXPROCS(n)
+		return
+	}
+	n, ok := cpuQuota()
+	if !ok || n >= runtime.GOMAXPROCS(0) || os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	log.Printf("Setting GOMAXPROCS to %v for the CPU quota\n", n)
+	runtime.GOMAXPROCS(n)
+}
+
+// limitMemory sets the soft memory limit of the runtime to -max-memory and
+// lowers the buffer sizes so that none takes more than its share of it
+func limitMemory(cfg *config) {
+	debug.SetMemoryLimit(cfg.maxMemory)
+	clamp := func(name string, v *int, size int64) {
+		if n := int(max(cfg.maxMemory/bufferShare/size, 1)); *v > n {
+			log.Printf("Warning: lowering -%v from %v to %v for -max-memory\n", name, *v, n)
+			*v = n
+		}
+	}
+	clamp("buffer", &cfg.buffer, dataSize)
+	clamp("grafana-history", &cfg.grafanaHistory, dataSize)
+	clamp("unmatched-lines", &cfg.unmatchedLines, unmatchedLineSize)
+}
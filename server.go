@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// server is the HTTP API serving the readings in st
+type server struct {
+	cfg  *config
+	st   *state
+	enc  *encoder
+	http *httpMetrics
+	done <-chan struct{} // closed on shutdown to end the streams
+
+	offers []string // media types of /data, the one of -format first
+}
+
+// dataFormats are the media types of the representations of /data by -format
+var dataFormats = map[string]string{
+	formatJSON:       "application/json",
+	formatXML:        "application/xml",
+	formatCBOR:       "application/cbor",
+	formatCSV:        "text/csv",
+	formatPrometheus: "text/plain",
+}
+
+// representations of /data given by -format
+const (
+	formatJSON       = "json"
+	formatXML        = "xml"
+	formatCBOR       = "cbor"
+	formatCSV        = "csv"
+	formatPrometheus = "prometheus" // the gauges of the reading in /metrics
+)
+
+// dataOffers returns the media types of /data for negotiate, starting with
+// the one of format, which is served without Accept or for */*
+func dataOffers(format string) []string {
+	offers := []string{dataFormats[format]}
+	for _, ct := range []string{"application/json", "application/xml", "text/xml", "application/cbor", "text/csv", "text/plain"} {
+		if ct != offers[0] {
+			offers = append(offers, ct)
+		}
+	}
+	return offers
+}
+
+func newServer(ctx context.Context, cfg *config, st *state) *server {
+	return &server{
+		cfg:  cfg,
+		st:   st,
+		enc:  newEncoder(cfg),
+		http: newHTTPMetrics(),
+		done: ctx.Done(),
+
+		offers: dataOffers(cfg.format),
+	}
+}
+
+// handler returns the handler routing the API endpoints
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	var endpoints []string
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, s.http.instrument(pattern, h))
+		endpoints = append(endpoints, pattern)
+	}
+	handle("/data", http.HandlerFunc(s.handleData))
+	handle("/info", http.HandlerFunc(s.handleInfo))
+	handle("/healthz", http.HandlerFunc(s.handleHealthz))
+	handle("/ready", http.HandlerFunc(s.handleReady))
+	handle("/homekit", http.HandlerFunc(s.handleHomeKit))
+	handle("/stream", http.HandlerFunc(s.handleStream))
+	handle("/metrics", http.HandlerFunc(s.handleMetrics))
+	if s.cfg.grafanaJSON {
+		handle("/grafana/", http.HandlerFunc(s.handleGrafana))
+		handle("/grafana/search", http.HandlerFunc(s.handleGrafanaSearch))
+		handle("/grafana/query", http.HandlerFunc(s.handleGrafanaQuery))
+	}
+	if s.cfg.authToken != "" {
+		handle("/pause", s.admin(s.handlePause))
+		handle("/resume", s.admin(s.handleResume))
+		handle("/flush", s.admin(s.handleFlush))
+		handle("/debug/unmatched", s.private(s.handleUnmatched))
+		handle("/debug/parser", s.private(s.handleParser))
+	}
+
+	if s.cfg.staticDir != "" {
+		// http.Dir rejects paths escaping the directory, and the more specific
+		// patterns above take precedence over "/"
+		mux.Handle("/", s.http.instrument("/", http.FileServer(http.Dir(s.cfg.staticDir))))
+	} else {
+		mux.Handle("/", s.http.instrument("/", indexHandler(endpoints)))
+	}
+	return mux
+}
+
+type indexResponse struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+// indexHandler lists the endpoints at / for discovery, responding 404 to other paths
+func indexHandler(endpoints []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, indexResponse{Endpoints: endpoints})
+	}
+}
+
+func (s *server) handleData(w http.ResponseWriter, r *http.Request) {
+	// the latest reading is always set once the reader is running
+	if status := s.st.Status(); status != statusRunning {
+		writeJSON(w, http.StatusServiceUnavailable, statusResponse{Status: status})
+		return
+	}
+	latest := s.st.Latest()
+
+	age := latest.age()
+	w.Header().Set("X-Reading-Age-Seconds", strconv.FormatFloat(age.Seconds(), 'f', 3, 64))
+	v := s.enc.view(latest)
+	if s.cfg.maxStale > 0 && age > s.cfg.maxStale {
+		if !s.cfg.serveStale {
+			writeJSON(w, http.StatusServiceUnavailable, statusResponse{Status: statusStale})
+			return
+		}
+		w.Header().Set("X-Stale", "true")
+		v.Stale = true
+	}
+
+	ct := negotiate(r, s.offers...)
+	var b []byte
+	var err error
+	header := ct
+	switch ct {
+	case "application/json":
+		b, err = v.JSON()
+	case "application/xml", "text/xml":
+		b, err = v.XML()
+	case "application/cbor":
+		b, err = v.CBOR()
+	case "text/csv":
+		b, err = v.CSV()
+		header = "text/csv; charset=utf-8"
+	case "text/plain":
+		var buf bytes.Buffer
+		writeReadingMetrics(s.newMetricsWriter(&buf, false), latest)
+		b, header = buf.Bytes(), contentTypePrometheus
+	default:
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", header)
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// statusResponse is the body of 503 responses telling why no reading is served
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+// handleStream streams each new reading as a line of JSON until the client disconnects
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	c, unsubscribe := s.st.subs.Subscribe(s.cfg.buffer)
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case d := <-c:
+			b, err := s.enc.JSON(d)
+			if err != nil {
+				log.Printf("Failed to encode reading: %v\n", err)
+				continue
+			}
+			if d.reconnected {
+				if _, err := w.Write(reconnectEvent); err != nil {
+					return
+				}
+			}
+			if _, err := w.Write(append(b, '\n')); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// info is the server and device status served at /info
+type info struct {
+	Device            string             `json:"device"`
+	DeviceID          string             `json:"device_id,omitempty"`
+	CO2Offset         int64              `json:"co2_offset"`
+	ParseSuccessRatio *float64           `json:"parse_success_ratio"`
+	Serial            *serialParams      `json:"serial"`
+	Gaps              uint64             `json:"gaps"`
+	Counters          readerCountersJSON `json:"counters"`
+}
+
+func (s *server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	i := info{
+		Device:    s.cfg.device,
+		DeviceID:  s.st.DeviceID(),
+		CO2Offset: s.cfg.co2Offset,
+		Serial:    s.st.Serial(),
+		Gaps:      s.st.Gaps(),
+		Counters:  s.st.counters.snapshot(),
+	}
+	if ratio, _ := s.st.parse.Ratio(); ratio >= 0 {
+		i.ParseSuccessRatio = &ratio
+	}
+	writeJSON(w, http.StatusOK, i)
+}
+
+// homeKit follows the semantics of the HomeKit carbon dioxide sensor service
+type homeKit struct {
+	CO2Detected bool  `json:"co2_detected"`
+	CO2Level    int64 `json:"co2_level"`
+	CO2Peak     int64 `json:"co2_peak"`
+}
+
+func (s *server) handleHomeKit(w http.ResponseWriter, r *http.Request) {
+	if status := s.st.Status(); status != statusRunning {
+		writeJSON(w, http.StatusServiceUnavailable, statusResponse{Status: status})
+		return
+	}
+	latest := s.st.Latest()
+	writeJSON(w, http.StatusOK, homeKit{
+		CO2Detected: latest.CO2 >= s.cfg.homeKitThreshold,
+		CO2Level:    latest.CO2,
+		CO2Peak:     s.st.Peak(),
+	})
+}
+
+// handleReady tells whether fresh readings are served, unlike /healthz
+// which only fails when the reader gave up
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	status := s.st.Status()
+	code := http.StatusOK
+	if status != statusRunning {
+		code = http.StatusServiceUnavailable
+	} else if s.cfg.maxStale > 0 && s.st.Latest().age() > s.cfg.maxStale {
+		status, code = statusStale, http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, statusResponse{Status: status})
+}
+
+// handleHealthz reports whether the reader is working; a paused reader is healthy
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := s.st.Status()
+	code := http.StatusOK
+	if status == statusUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, statusResponse{Status: status})
+}
+
+func (s *server) handlePause(w http.ResponseWriter, r *http.Request) {
+	if err := s.st.Pause(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: statusPaused})
+}
+
+func (s *server) handleResume(w http.ResponseWriter, r *http.Request) {
+	if err := s.st.Resume(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: s.st.Status()})
+}
+
+type flushResponse struct {
+	Flushed map[string]int `json:"flushed"` // readings written by sink
+}
+
+// handleFlush makes the sinks write out their queued readings without waiting
+func (s *server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	writeJSON(w, http.StatusOK, flushResponse{Flushed: s.st.flushers.Flush(ctx)})
+}
+
+type unmatchedResponse struct {
+	Lines []unmatchedLine `json:"lines"`
+}
+
+func (s *server) handleUnmatched(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, unmatchedResponse{Lines: s.st.unmatched.Lines()})
+}
+
+type parserResponse struct {
+	Pattern string       `json:"pattern"`
+	Groups  []string     `json:"groups"`
+	Lines   []parsedLine `json:"lines"`
+}
+
+func (s *server) handleParser(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, parserResponse{
+		Pattern: readingPattern.String(),
+		Groups:  readingPattern.SubexpNames()[1:],
+		Lines:   s.st.parsed.Lines(),
+	})
+}
+
+// authorize checks the bearer token of r, responding 401 if it does not match
+func (s *server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	want := []byte("Bearer " + s.cfg.authToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return false
+	}
+	return true
+}
+
+// private guards a read-only endpoint exposing what the device emits with the bearer token
+func (s *server) private(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r) {
+			return
+		}
+		h(w, r)
+	})
+}
+
+// admin guards an endpoint changing the server state: it accepts only POST
+// with the auth token, and a body, if any, must be JSON within the size limit.
+func (s *server) admin(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if !s.authorize(w, r) {
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.maxBodySize))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %v bytes", mbe.Limit))
+				return
+			}
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(body) > 0 {
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		h(w, r)
+	})
+}
+
+// errorResponse is the body of JSON error responses
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// httpHandler returns the handler of the HTTP server, speaking h2c with -h2c
+func httpHandler(ctx context.Context, cfg *config, st *state) http.Handler {
+	h := newServer(ctx, cfg, st).handler()
+	if cfg.h2c {
+		// HTTP/2 without TLS, upgrading from HTTP/1.1 or with prior knowledge
+		h = h2c.NewHandler(h, &http2.Server{})
+	}
+	return h
+}
+
+// runServer serves the HTTP API until ctx is done
+func runServer(ctx context.Context, cfg *config, st *state) error {
+	s := &http.Server{
+		Addr:    cfg.addr,
+		Handler: httpHandler(ctx, cfg, st),
+	}
+
+	// Serve returns as soon as Shutdown is called, so wait for the
+	// requests in flight to finish before returning
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Println("Shutting down HTTP server...")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		log.Println("HTTP server stopped.")
+	}()
+
+	if !cfg.httpKeepAlive {
+		// each response is sent with Connection: close
+		s.SetKeepAlivesEnabled(false)
+	}
+
+	lc := net.ListenConfig{}
+	if cfg.reuseAddr {
+		lc.Control = reuseAddrControl
+	}
+	l, err := listen(ctx, lc, s.Addr, cfg.addrFallback)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	if err := s.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// testReading returns the reading parsed from a line of the device
+func testReading(t *testing.T, line string) *Data {
+	t.Helper()
+	m := readingPattern.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("not a reading: %v", line)
+	}
+	d, err := parseData(m, time.Now(), humidityBasisRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// get serves a GET of path by h with the Accept header, failing unless it is 200
+func get(t *testing.T, h http.Handler, path, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %v: %v %s", path, w.Code, w.Body)
+	}
+	return w
+}
+
+func TestDataJSONAndXMLAgree(t *testing.T) {
+	cfg := testConfig(t, "-device", simDevice)
+	st := newState(cfg)
+	h := newServer(context.Background(), cfg, st).handler()
+	d := testReading(t, "CO2=650,HUM=45.0,TMP=27.0")
+	d.Location = "office"
+	st.Update(d)
+
+	// the fields both documents carry, in the types they are compared in
+	type reading struct {
+		SchemaVersion int      `json:"schema_version" xml:"schema_version"`
+		ID            string   `json:"id" xml:"id"`
+		CO2           int64    `json:"co2" xml:"co2"`
+		CO2Unit       string   `json:"co2_unit" xml:"co2_unit"`
+		Humidity      *float64 `json:"humidity" xml:"humidity"`
+		Temperature   *float64 `json:"temperature" xml:"temperature"`
+		Timestamp     string   `json:"timestamp" xml:"timestamp"`
+		Seq           uint64   `json:"seq" xml:"seq"`
+		Location      string   `json:"location" xml:"location"`
+	}
+	var j, x reading
+	w := get(t, h, "/data", "application/json")
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+		t.Fatal(err)
+	}
+	w = get(t, h, "/data", "application/xml")
+	if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("Content-Type = %v, want application/xml", ct)
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &x); err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Humidity == nil || x.Humidity == nil || j.Temperature == nil || x.Temperature == nil {
+		t.Fatalf("missing values: JSON %+v, XML %+v", j, x)
+	}
+	if *j.Humidity != *x.Humidity || *j.Temperature != *x.Temperature {
+		t.Errorf("humidity and temperature differ: JSON %v %v, XML %v %v", *j.Humidity, *j.Temperature, *x.Humidity, *x.Temperature)
+	}
+	j.Humidity, j.Temperature, x.Humidity, x.Temperature = nil, nil, nil, nil
+	if j != x {
+		t.Errorf("JSON %+v and XML %+v differ", j, x)
+	}
+	if j.CO2 != 650 || j.Seq != 1 || j.Location != "office" || j.Timestamp == "" {
+		t.Errorf("unexpected reading %+v", j)
+	}
+}
+
+func TestStreamFlushesOverH2C(t *testing.T) {
+	cfg := testConfig(t, "-device", simDevice, "-h2c")
+	st := newState(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := httptest.NewServer(httpHandler(ctx, cfg, st))
+	defer ts.Close()
+
+	// HTTP/2 with prior knowledge over a plain TCP connection
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get(ts.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("protocol %v, want HTTP/2", resp.Proto)
+	}
+
+	// a reading published while the stream is open has to arrive on its
+	// own, without the response being closed or more data written
+	waitFor(t, "the subscriber", func() bool { return st.subs.Len() == 1 })
+	lines := make(chan string, 1)
+	go func() {
+		s := bufio.NewScanner(resp.Body)
+		if s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	st.Update(testReading(t, testLine))
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, `"co2":650`) {
+			t.Errorf("streamed %v, want the reading", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reading was not flushed")
+	}
+}
+
+// TestEndpointsConcurrently serves every representation of the readings at
+// once while they are updated, which is meant to be run with -race
+func TestEndpointsConcurrently(t *testing.T) {
+	cfg := testConfig(t, "-device", simDevice, "-direction-window", "1m", "-comfort", "-mark-gaps", "-grafana-json", "-vent-on", "1000", "-vent-off", "800")
+	st := newState(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := httptest.NewServer(httpHandler(ctx, cfg, st))
+	defer ts.Close()
+	st.Update(testReading(t, testLine))
+
+	const updates = 200
+	var wg sync.WaitGroup
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 0; i < updates; i++ {
+			st.Update(testReading(t, fmt.Sprintf("CO2=%d,HUM=45.0,TMP=27.0", 600+i)))
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	requests := []struct {
+		method, path, accept, body string
+	}{
+		{http.MethodGet, "/data", "application/json", ""},
+		{http.MethodGet, "/data", "application/xml", ""},
+		{http.MethodGet, "/data", "application/cbor", ""},
+		{http.MethodGet, "/metrics", "", ""},
+		{http.MethodGet, "/info", "", ""},
+		{http.MethodGet, "/homekit", "", ""},
+		{http.MethodGet, "/ready", "", ""},
+		{http.MethodPost, "/grafana/query", "", `{"range":{"from":"2000-01-01T00:00:00Z","to":"2100-01-01T00:00:00Z"},"targets":[{"target":"co2"}]}`},
+	}
+	for _, req := range requests {
+		req := req
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-updated:
+					return
+				default:
+				}
+				r, err := http.NewRequest(req.method, ts.URL+req.path, strings.NewReader(req.body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if req.accept != "" {
+					r.Header.Set("Accept", req.accept)
+				}
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("%v %v: %v", req.method, req.path, resp.Status)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/stream", nil)
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				if ctx.Err() == nil {
+					t.Error(err)
+				}
+				return
+			}
+			defer resp.Body.Close()
+			s := bufio.NewScanner(resp.Body)
+			for s.Scan() {
+				var v struct {
+					Seq uint64 `json:"seq"`
+				}
+				if ctx.Err() != nil {
+					return // the line may be cut off
+				}
+				if err := json.Unmarshal(s.Bytes(), &v); err != nil {
+					t.Errorf("streamed %s: %v", s.Bytes(), err)
+					return
+				}
+				if v.Seq > updates {
+					return
+				}
+			}
+		}()
+	}
+
+	<-updated
+	cancel() // ends the streams that missed the last reading
+	wg.Wait()
+}
+
+func TestStreamSurvivesReconnect(t *testing.T) {
+	p1, p2 := newFakePort(), newFakePort()
+	useFakePorts(t, p1, p2)
+	cfg := testConfig(t, "-device", "/dev/ttyFAKE", "-reconnect-delay", "10ms")
+	st := newState(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := httptest.NewServer(httpHandler(ctx, cfg, st))
+	defer ts.Close()
+	stop := startReader(t, cfg, st)
+
+	resp, err := http.Get(ts.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				t.Fatal("the stream ended")
+			}
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing streamed")
+			return ""
+		}
+	}
+	waitFor(t, "the subscriber", func() bool { return st.subs.Len() == 1 })
+
+	<-p1.started
+	p1.send(testLine)
+	if l := next(); !strings.Contains(l, `"seq":1`) {
+		t.Errorf("streamed %v, want the first reading", l)
+	}
+	p1.Close() // cycle the port
+	<-p2.started
+	p2.send(testLine)
+	if l := next(); l != strings.TrimSpace(string(reconnectEvent)) {
+		t.Errorf("streamed %v, want the reconnect event", l)
+	}
+	if l := next(); !strings.Contains(l, `"seq":2`) {
+		t.Errorf("streamed %v, want the reading after the reconnect", l)
+	}
+	if n := st.subs.Len(); n != 1 {
+		t.Errorf("%v subscribers, want 1", n)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("reader failed: %v", err)
+	}
+}
+
+func TestMetricsSinkQueueLength(t *testing.T) {
+	cfg := testConfig(t, "-device", simDevice)
+	st := newState(cfg)
+	h := newServer(context.Background(), cfg, st).handler()
+	if b := get(t, h, "/metrics", "").Body.String(); strings.Contains(b, "udco2s_sink_queue_length") {
+		t.Errorf("queue length reported without a sink:\n%s", b)
+	}
+
+	// a sink that has not written out the last two readings yet
+	_, unsubscribe := st.subs.SubscribeSink("redis", 4)
+	defer unsubscribe()
+	st.Update(testReading(t, testLine))
+	st.Update(testReading(t, testLine))
+	b := get(t, h, "/metrics", "").Body.String()
+	if !strings.Contains(b, "# TYPE udco2s_sink_queue_length gauge\n") || !strings.Contains(b, `sink="redis"} 2`+"\n") {
+		t.Errorf("queue length of the sink not reported as 2:\n%s", b)
+	}
+}
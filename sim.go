@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simDevice is the device name that selects the simulator
+const simDevice = "sim"
+
+// simPort emulates a UD-CO2S on the serial protocol level.
+// It answers the commands used by prepareDevice and, while started,
+// streams a line taken from next at each interval until next runs out.
+type simPort struct {
+	interval time.Duration
+	next     func() (string, bool)
+
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+	cmds chan string
+	done chan struct{}
+	once sync.Once
+}
+
+func newSimPort(interval time.Duration, next func() (string, bool)) *simPort {
+	pr, pw := io.Pipe()
+	p := &simPort{
+		interval: interval,
+		next:     next,
+		pr:       pr,
+		pw:       pw,
+		cmds:     make(chan string, 8),
+		done:     make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *simPort) loop() {
+	defer p.pw.Close()
+
+	var tick <-chan time.Time
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		var line string
+		select {
+		case <-p.done:
+			return
+		case c := <-p.cmds:
+			switch c {
+			case "STA":
+				tick = ticker.C
+				line = "OK STA"
+			case "STP":
+				tick = nil
+				line = "OK STP"
+			case "ID?":
+				line = "OK ID=SIM"
+			default:
+				line = "NG"
+			}
+		case <-tick:
+			var ok bool
+			if line, ok = p.next(); !ok {
+				return
+			}
+		}
+		if _, err := io.WriteString(p.pw, line+"\r\n"); err != nil {
+			return
+		}
+	}
+}
+
+func (p *simPort) Read(b []byte) (int, error) {
+	return p.pr.Read(b)
+}
+
+func (p *simPort) Write(b []byte) (int, error) {
+	for _, c := range strings.Split(string(b), "\r\n") {
+		if c == "" {
+			continue
+		}
+		select {
+		case <-p.done:
+			return 0, errors.New("port closed")
+		case p.cmds <- c:
+		}
+	}
+	return len(b), nil
+}
+
+func (p *simPort) SetReadTimeout(t time.Duration) error {
+	return nil
+}
+
+func (p *simPort) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		p.pr.Close()
+	})
+	return nil
+}
+
+// randomWalk returns reading lines whose values follow a gentle random walk,
+// staying in a plausible indoor range
+func randomWalk(seed int64) func() (string, bool) {
+	rnd := rand.New(rand.NewSource(seed))
+	co2, hum, tmp := 600.0, 45.0, 27.0
+	walk := func(v, d, lo, hi float64) float64 {
+		v += (rnd.Float64()*2 - 1) * d
+		return math.Min(math.Max(v, lo), hi)
+	}
+	return func() (string, bool) {
+		co2 = walk(co2, 10, 400, 2000)
+		hum = walk(hum, 0.2, 20, 80)
+		tmp = walk(tmp, 0.05, 15, 35)
+		return fmt.Sprintf("CO2=%d,HUM=%.1f,TMP=%.1f", int64(co2), hum, tmp), true
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// statuses of the reader
+const (
+	statusInitializing = "initializing"
+	statusRunning      = "running"
+	statusUnavailable  = "unavailable"
+	statusPaused       = "paused"
+	// the device stopped responding or failed to read and is reopened after -reconnect-delay
+	statusReconnecting = "reconnecting"
+	// the latest reading is older than -max-stale
+	statusStale = "stale"
+)
+
+// state holds the readings shared between the reader and the HTTP server.
+// A *Data is never modified once stored or published, so the handlers of
+// all the endpoints may encode it concurrently without further locking.
+type state struct {
+	mu     sync.RWMutex
+	latest *Data
+	seq    uint64
+	status string
+	peak   int64 // highest CO2 since startup
+	serial *serialParams
+	id     string // identification reported by the device
+	ids    *idGenerator
+
+	// gap detection, disabled if gapFactor is 0
+	gapFactor   float64
+	markGaps    bool
+	avgInterval float64 // moving average of the intervals without gaps in seconds
+	gaps        uint64
+
+	// ventilation with hysteresis, disabled if ventOn is 0
+	ventOn, ventOff int64
+	ventilate       bool
+
+	trend   *trend   // nil if disabled
+	history *history // nil without -grafana-json
+
+	parse     *parseStats
+	counters  readerCounters
+	unmatched *unmatchedLines
+	parsed    *parsedLines
+	ctl       *control
+	subs      *broker
+	flushers  *flushers
+}
+
+func newState(cfg *config) *state {
+	s := &state{
+		status:    statusInitializing,
+		parse:     newParseStats(cfg.parseWindow),
+		unmatched: newUnmatchedLines(cfg.unmatchedLines),
+		parsed:    newParsedLines(parserSamples),
+		ctl:       &control{},
+		subs:      newBroker(),
+		flushers:  newFlushers(),
+		ids:       newIDGenerator(cfg),
+		gapFactor: cfg.gapFactor,
+		markGaps:  cfg.markGaps,
+		ventOn:    cfg.ventOn,
+		ventOff:   cfg.ventOff,
+	}
+	if cfg.directionWindow > 0 {
+		s.trend = newTrend(cfg.directionWindow, cfg.directionDeadband)
+	}
+	if cfg.grafanaJSON {
+		s.history = newHistory(cfg.grafanaHistory)
+	}
+	return s
+}
+
+// Update stores d as the latest reading, filling in the fields derived from the previous one
+func (s *state) Update(d *Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctl.Paused() {
+		return // drop the readings still in flight, also across a reconnect
+	}
+	d.reconnected = s.status == statusReconnecting
+	s.status = statusRunning
+	s.seq++
+	if d.CO2 > s.peak {
+		s.peak = d.CO2
+	}
+	if s.ventOn > 0 {
+		if d.CO2 >= s.ventOn {
+			s.ventilate = true
+		} else if d.CO2 < s.ventOff {
+			s.ventilate = false
+		}
+		v := s.ventilate
+		d.Ventilate = &v
+	}
+	if s.trend != nil {
+		d.CO2Direction = s.trend.Add(d)
+	}
+	d.Seq = s.seq
+	d.ID = s.ids.New(time.Time(d.Timestamp))
+	if s.latest != nil {
+		i := (d.elapsed - s.latest.elapsed).Seconds()
+		d.IntervalSeconds = &i
+		s.detectGap(d, i)
+	}
+	s.latest = d
+	if s.history != nil {
+		s.history.Add(d)
+	}
+	// d is shared read-only from here on, so it must be complete
+	s.subs.Publish(d)
+}
+
+// detectGap counts the interval i before d as a gap if it exceeds the
+// average interval by gapFactor, and averages it in otherwise
+func (s *state) detectGap(d *Data, i float64) {
+	if s.gapFactor <= 0 {
+		return
+	}
+	if s.avgInterval > 0 && i > s.avgInterval*s.gapFactor {
+		s.gaps++
+		log.Printf("Warning: gap of %.1fs before reading %v, expected about %.1fs\n", i, d.Seq, s.avgInterval)
+		d.AfterGap = s.markGaps
+		return
+	}
+	if s.avgInterval == 0 {
+		s.avgInterval = i
+	} else {
+		s.avgInterval += (i - s.avgInterval) / 8
+	}
+}
+
+// Gaps returns the number of gaps detected between readings since startup
+func (s *state) Gaps() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gaps
+}
+
+// Latest returns the latest reading, or nil if there is none yet
+func (s *state) Latest() *Data {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latest
+}
+
+// Seq returns the number of readings stored since startup
+func (s *state) Seq() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq
+}
+
+// Peak returns the highest CO2 since startup
+func (s *state) Peak() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peak
+}
+
+// SetStatus sets the status of the reader
+func (s *state) SetStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// SetSerial sets the parameters of the serial port in use, nil if it is not one
+func (s *state) SetSerial(p *serialParams) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serial = p
+}
+
+// SetDeviceID sets the identification reported by the device, "" if none
+func (s *state) SetDeviceID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = id
+}
+
+// DeviceID returns the identification reported by the device, or ""
+func (s *state) DeviceID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.id
+}
+
+// Serial returns the parameters of the serial port in use, or nil
+func (s *state) Serial() *serialParams {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.serial
+}
+
+// Status returns the status of the reader
+func (s *state) Status() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// Pause pauses the reading and marks the state as paused
+func (s *state) Pause() error {
+	if err := s.ctl.Pause(); err != nil {
+		return err
+	}
+	s.SetStatus(statusPaused)
+	return nil
+}
+
+// Resume resumes the reading, serving the latest reading again until a new one arrives
+func (s *state) Resume() error {
+	if err := s.ctl.Resume(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latest != nil {
+		s.status = statusRunning
+	} else {
+		s.status = statusInitializing
+	}
+	return nil
+}
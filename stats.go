@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// runStats logs a summary of the process every interval until ctx is done
+func runStats(ctx context.Context, interval time.Duration, st *state) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	last := st.Seq()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		seq := st.Seq()
+		attrs := []any{
+			"readings_per_minute", float64(seq-last) / interval.Minutes(),
+			"readings", seq,
+			"status", st.Status(),
+			"subscribers", st.subs.Len(),
+			"goroutines", runtime.NumGoroutine(),
+		}
+		queues := st.subs.Queues()
+		sinks := make([]string, 0, len(queues))
+		for name := range queues {
+			sinks = append(sinks, name)
+		}
+		sort.Strings(sinks)
+		for _, name := range sinks {
+			attrs = append(attrs, name+"_queue", queues[name])
+		}
+		if d := st.Latest(); d != nil {
+			attrs = append(attrs, "co2", d.CO2)
+		}
+		slog.Info("stats", attrs...)
+		last = seq
+	}
+}
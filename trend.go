@@ -0,0 +1,69 @@
+package main
+
+import "time"
+
+// directions of the CO2 given with -direction-window
+const (
+	directionRising  = "rising"
+	directionFalling = "falling"
+	directionStable  = "stable"
+	// there are too few readings in the window to tell
+	directionUnknown = "unknown"
+)
+
+// minTrendSamples is the number of readings in the window required for a direction
+const minTrendSamples = 3
+
+type trendSample struct {
+	elapsed time.Duration
+	co2     int64
+}
+
+// trend tells the direction of the CO2 from the slope of the readings within
+// window, which is stable while it is within deadband ppm per minute
+type trend struct {
+	window   time.Duration
+	deadband float64
+	samples  []trendSample
+}
+
+func newTrend(window time.Duration, deadband float64) *trend {
+	return &trend{window: window, deadband: deadband}
+}
+
+// Add adds d to the window and returns the direction including it
+func (t *trend) Add(d *Data) string {
+	t.samples = append(t.samples, trendSample{d.elapsed, d.CO2})
+	i := 0
+	for d.elapsed-t.samples[i].elapsed > t.window {
+		i++
+	}
+	t.samples = t.samples[i:]
+	if len(t.samples) < minTrendSamples {
+		return directionUnknown
+	}
+
+	// least squares slope in ppm per minute
+	var n, sx, sy, sxx, sxy float64
+	for _, s := range t.samples {
+		x := (s.elapsed - t.samples[0].elapsed).Minutes()
+		y := float64(s.co2)
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return directionUnknown // all at the same time
+	}
+	switch slope := (n*sxy - sx*sy) / den; {
+	case slope > t.deadband:
+		return directionRising
+	case slope < -t.deadband:
+		return directionFalling
+	default:
+		return directionStable
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+)
+
+// unmatchedLine is a line read from the device that is not a reading
+type unmatchedLine struct {
+	Time ISO8601Time `json:"time"`
+	Line string      `json:"line"` // sanitized
+}
+
+// unmatchedLines keeps the most recent unmatched lines
+type unmatchedLines struct {
+	lines *ring[unmatchedLine]
+}
+
+func newUnmatchedLines(size int) *unmatchedLines {
+	return &unmatchedLines{lines: newRing[unmatchedLine](size)}
+}
+
+// Add keeps line, dropping the oldest one if the buffer is full
+func (u *unmatchedLines) Add(t time.Time, line string) {
+	u.lines.Add(unmatchedLine{ISO8601Time(t), sanitize(line)})
+}
+
+// Lines returns the kept lines, oldest first
+func (u *unmatchedLines) Lines() []unmatchedLine {
+	return u.lines.Values()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// minWatchdog is the shortest idle period of the watchdog, which checks on the device every quarter of it
+const minWatchdog = time.Second
+
+// watchdog probes the device with `ID?` when no valid reading arrived for idle,
+// and closes the port when the probe is not answered within another idle period.
+type watchdog struct {
+	idle time.Duration
+
+	mu     sync.Mutex
+	last   time.Time // last valid reading or probe response
+	probed time.Time // time of the pending probe, zero if none
+	fired  bool
+}
+
+func newWatchdog(idle time.Duration) *watchdog {
+	return &watchdog{idle: idle, last: time.Now()}
+}
+
+// Alive records that the device is responding
+func (w *watchdog) Alive() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = time.Now()
+	w.probed = time.Time{}
+}
+
+// Fired reports whether the watchdog gave up on the device
+func (w *watchdog) Fired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fired
+}
+
+func (w *watchdog) run(ctx context.Context, p port, paused func() bool) {
+	t := time.NewTicker(w.idle / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if paused() {
+			w.Alive() // no reading is expected
+			continue
+		}
+
+		w.mu.Lock()
+		now := time.Now()
+		switch {
+		case w.probed.IsZero() && now.Sub(w.last) >= w.idle:
+			log.Printf("No reading for %v, probing device...\n", w.idle)
+			w.probed = now
+			w.mu.Unlock()
+			if _, err := p.Write([]byte("ID?\r\n")); err != nil {
+				log.Printf("Failed to probe device: %v\n", err)
+			}
+			continue
+		case !w.probed.IsZero() && now.Sub(w.probed) >= w.idle:
+			log.Println("Device is not responding.")
+			w.fired = true
+			w.mu.Unlock()
+			p.Close() // unblock the scanner
+			return
+		}
+		w.mu.Unlock()
+	}
+}